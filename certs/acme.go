@@ -0,0 +1,99 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig configures automatic certificate provisioning
+type ACMEConfig struct {
+	// Domains are the only host names certificates are requested for
+	Domains []string
+	// DirectoryURL defaults to Let's Encrypt. Point it at a local Pebble server for testing.
+	DirectoryURL string
+	Email        string
+	// CacheDir stores the account key and issued certificates across restarts
+	CacheDir string
+	// CABundle optionally holds extra root certificates trusted when talking to the ACME server, e.g. Pebble's
+	CABundle string
+}
+
+// ParseDomains splits a comma separated list of host names
+func ParseDomains(list string) []string {
+	var domains []string
+	for _, d := range strings.Split(list, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// NewACMEManager creates a manager that obtains and renews certificates for the configured domains
+// using the HTTP-01 and TLS-ALPN-01 challenges
+func NewACMEManager(c ACMEConfig) (*autocert.Manager, error) {
+	if len(c.Domains) == 0 {
+		return nil, errors.New("ACME requires at least one domain")
+	}
+	if c.CacheDir == "" {
+		return nil, errors.New("ACME requires a certificate cache directory")
+	}
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("Loading ACME CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in ACME CA bundle %s", c.CABundle)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Cache:      autocert.DirCache(c.CacheDir),
+		Email:      c.Email,
+		Client:     client,
+	}, nil
+}
+
+// WithACME returns a GetCertificate callback that serves ACME certificates for the manager's domains
+// and TLS-ALPN-01 challenges, falling back to the file based store for any other name.
+// store may be nil, in which case every handshake is answered by the manager.
+func WithACME(m *autocert.Manager, domains []string, store *Store) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	acmeDomains := map[string]bool{}
+	for _, d := range domains {
+		acmeDomains[strings.ToLower(d)] = true
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if store == nil || acmeDomains[strings.ToLower(hello.ServerName)] {
+			return m.GetCertificate(hello)
+		}
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return m.GetCertificate(hello)
+			}
+		}
+		return store.GetCertificate(hello)
+	}
+}
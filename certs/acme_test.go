@@ -0,0 +1,92 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	cases := []struct {
+		cfg   ACMEConfig
+		fails bool
+	}{
+		{ACMEConfig{Domains: []string{"dashboard.example.com"}, CacheDir: t.TempDir()}, false},
+		{ACMEConfig{Domains: nil, CacheDir: t.TempDir()}, true},
+		{ACMEConfig{Domains: []string{"dashboard.example.com"}}, true},
+		{ACMEConfig{Domains: []string{"dashboard.example.com"}, CacheDir: t.TempDir(), CABundle: "missing.pem"}, true},
+	}
+
+	for _, c := range cases {
+		m, err := NewACMEManager(c.cfg)
+		if (err != nil) != c.fails {
+			t.Errorf("NewACMEManager(%+v) error: %v, want failure: %v", c.cfg, err, c.fails)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.HostPolicy(context.Background(), "dashboard.example.com") != nil {
+			t.Errorf("Configured domain was rejected by the host policy")
+		}
+		if m.HostPolicy(context.Background(), "attacker.example.org") == nil {
+			t.Errorf("Unconfigured domain was accepted by the host policy")
+		}
+	}
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+	m, err := NewACMEManager(ACMEConfig{Domains: []string{"dashboard.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create ACME manager: %v \n", err)
+	}
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://dashboard.example.com"+r.URL.Path, http.StatusPermanentRedirect)
+	})
+	handler := m.HTTPHandler(fallback)
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/login", http.StatusPermanentRedirect},
+		//unknown challenge tokens are not served
+		{"/.well-known/acme-challenge/unknown-token", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://dashboard.example.com"+c.path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("GET %s returned %v, want %v", c.path, rr.Code, c.status)
+		}
+	}
+}
+
+func TestWithACMEFallsBackToStore(t *testing.T) {
+	dir := t.TempDir()
+	spec, _, _ := writeCert(t, dir, "internal", 3, "dashboard.internal")
+	store, err := NewStore([]Spec{spec}, testLogger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v \n", err)
+	}
+	m, err := NewACMEManager(ACMEConfig{Domains: []string{"dashboard.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create ACME manager: %v \n", err)
+	}
+
+	getCertificate := WithACME(m, []string{"dashboard.example.com"}, store)
+	cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "dashboard.internal"})
+	if err != nil || cert.Leaf.SerialNumber.Int64() != 3 {
+		t.Errorf("Non-ACME name was not served from the store: %v", err)
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	domains := ParseDomains(" a.example.com, ,b.example.com")
+	if len(domains) != 2 || domains[0] != "a.example.com" || domains[1] != "b.example.com" {
+		t.Errorf("Unexpected domains: %v", domains)
+	}
+}
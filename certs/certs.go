@@ -0,0 +1,254 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Spec locates a certificate, its private key and optionally a DER encoded OCSP response to staple
+type Spec struct {
+	CertPath string
+	KeyPath  string
+	OCSPPath string
+}
+
+// Store serves TLS certificates that can be replaced on disk without restarting the server.
+// The first certificate is the default for clients that do not send SNI or match no other certificate.
+type Store struct {
+	Logger *slog.Logger
+	specs  []Spec
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStore loads every certificate in specs. At least one spec is required.
+func NewStore(specs []Spec, logger *slog.Logger) (*Store, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("No TLS certificate configured")
+	}
+	s := &Store{Logger: logger, specs: specs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads all certificates from disk. If any fails to load the previous certificates stay in use.
+func (s *Store) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.specs))
+	modTimes := map[string]time.Time{}
+	for _, spec := range s.specs {
+		cert, err := s.load(spec)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		for _, path := range []string{spec.CertPath, spec.KeyPath, spec.OCSPPath} {
+			if info, err := os.Stat(path); err == nil {
+				modTimes[path] = info.ModTime()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.modTimes = modTimes
+	s.mu.Unlock()
+	s.Logger.Info("Loaded TLS certificates", "count", len(certs))
+	return nil
+}
+
+func (s *Store) load(spec Spec) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(spec.CertPath, spec.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Loading %s: %v", spec.CertPath, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("Parsing %s: %v", spec.CertPath, err)
+		}
+	}
+	if spec.OCSPPath == "" {
+		return &cert, nil
+	}
+
+	staple, err := os.ReadFile(spec.OCSPPath)
+	if err != nil {
+		return nil, fmt.Errorf("Loading %s: %v", spec.OCSPPath, err)
+	}
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		if issuer, err = x509.ParseCertificate(cert.Certificate[1]); err != nil {
+			return nil, fmt.Errorf("Parsing issuer of %s: %v", spec.CertPath, err)
+		}
+	}
+	resp, err := ocsp.ParseResponse(staple, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing %s: %v", spec.OCSPPath, err)
+	}
+	// A stale response would make strict clients reject the handshake, so it is better not to staple at all
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(time.Now()) {
+		s.Logger.Warn("OCSP response is stale and will not be stapled", "path", spec.OCSPPath, "next_update", resp.NextUpdate)
+		return &cert, nil
+	}
+	if resp.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		return nil, fmt.Errorf("OCSP response %s does not match %s", spec.OCSPPath, spec.CertPath)
+	}
+	cert.OCSPStaple = staple
+	return &cert, nil
+}
+
+// GetCertificate picks the certificate matching the client's SNI name. It is meant for tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if cert.Leaf != nil && cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Watch polls the certificate files every interval and reloads them when any has changed, until Stop is called
+func (s *Store) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+				if err := s.Reload(); err != nil {
+					s.Logger.Error("Failed to reload TLS certificates, keeping the previous ones", "error", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the watcher started by Watch. It is a no-op if none is running.
+func (s *Store) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *Store) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, spec := range s.specs {
+		for _, path := range []string{spec.CertPath, spec.KeyPath, spec.OCSPPath} {
+			if path == "" {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(s.modTimes[path]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseSpecs parses a comma separated list of cert.pem:key.pem[:ocsp.der] entries
+func ParseSpecs(list string) ([]Spec, error) {
+	var specs []Spec
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Invalid certificate entry %q, expected cert:key[:ocsp]", entry)
+		}
+		spec := Spec{CertPath: parts[0], KeyPath: parts[1]}
+		if len(parts) == 3 {
+			spec.OCSPPath = parts[2]
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates, e.g. to verify client certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Loading %s: %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ParseMinVersion converts "1.2" or "1.3" into a tls version constant
+func ParseMinVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported minimum TLS version %q", v)
+}
+
+// ParseCipherSuites converts a comma separated list of cipher suite names, as listed by tls.CipherSuites,
+// into their IDs. An empty list selects Go's defaults. Insecure suites are rejected.
+// The list only applies to TLS 1.2, as TLS 1.3 suites are not configurable.
+func ParseCipherSuites(list string) ([]uint16, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
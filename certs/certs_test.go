@@ -0,0 +1,202 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"iotdashboard/utils"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var testLogger = utils.NewLogger(io.Discard, "text", slog.LevelInfo)
+
+// writeCert writes a self-signed certificate for the given DNS names and returns its spec
+func writeCert(t *testing.T, dir, name string, serial int64, dnsNames ...string) (Spec, *x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v \n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v \n", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v \n", err)
+	}
+
+	spec := Spec{CertPath: filepath.Join(dir, name+"-cert.pem"), KeyPath: filepath.Join(dir, name+"-key.pem")}
+	os.WriteFile(spec.CertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(spec.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return spec, cert, key
+}
+
+func TestGetCertificateSNI(t *testing.T) {
+	dir := t.TempDir()
+	defaultSpec, _, _ := writeCert(t, dir, "default", 1, "dashboard.local")
+	otherSpec, _, _ := writeCert(t, dir, "other", 2, "iot.example.com", "*.iot.example.com")
+
+	store, err := NewStore([]Spec{defaultSpec, otherSpec}, testLogger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v \n", err)
+	}
+
+	cases := []struct {
+		serverName string
+		serial     int64
+	}{
+		{"", 1},
+		{"dashboard.local", 1},
+		{"iot.example.com", 2},
+		{"gateway.iot.example.com", 2},
+		{"unknown.org", 1},
+	}
+	for _, c := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if err != nil {
+			t.Errorf("GetCertificate(%q) failed: %v", c.serverName, err)
+			continue
+		}
+		if cert.Leaf.SerialNumber.Int64() != c.serial {
+			t.Errorf("GetCertificate(%q) returned serial %v, want %v", c.serverName, cert.Leaf.SerialNumber, c.serial)
+		}
+	}
+}
+
+func TestWatchReloadsChangedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	spec, _, _ := writeCert(t, dir, "server", 1, "dashboard.local")
+
+	store, err := NewStore([]Spec{spec}, testLogger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v \n", err)
+	}
+	store.Watch(10 * time.Millisecond)
+	defer store.Stop()
+
+	//replace the certificate on disk with a newer modification time
+	writeCert(t, dir, "server", 2, "dashboard.local")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(spec.CertPath, later, later)
+	os.Chtimes(spec.KeyPath, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+		if cert.Leaf.SerialNumber.Int64() == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Certificate was not reloaded after it changed on disk")
+}
+
+func TestReloadKeepsPreviousOnError(t *testing.T) {
+	dir := t.TempDir()
+	spec, _, _ := writeCert(t, dir, "server", 1, "dashboard.local")
+
+	store, err := NewStore([]Spec{spec}, testLogger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v \n", err)
+	}
+	os.WriteFile(spec.KeyPath, []byte("garbage"), 0600)
+
+	if err := store.Reload(); err == nil {
+		t.Errorf("Reload succeeded with a corrupt key")
+	}
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{}); cert == nil || cert.Leaf.SerialNumber.Int64() != 1 {
+		t.Errorf("Previous certificate was not kept after a failed reload")
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	dir := t.TempDir()
+	spec, cert, key := writeCert(t, dir, "server", 7, "dashboard.local")
+
+	cases := []struct {
+		serial     int64
+		nextUpdate time.Time
+		stapled    bool
+		fails      bool
+	}{
+		{7, time.Now().Add(time.Hour), true, false},
+		{7, time.Now().Add(-time.Hour), false, false},
+		{8, time.Now().Add(time.Hour), false, true},
+	}
+
+	for _, c := range cases {
+		resp, err := ocsp.CreateResponse(cert, cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(c.serial),
+			ThisUpdate:   time.Now().Add(-2 * time.Hour),
+			NextUpdate:   c.nextUpdate,
+		}, key)
+		if err != nil {
+			t.Fatalf("Failed to create OCSP response: %v \n", err)
+		}
+		spec.OCSPPath = filepath.Join(dir, "server.ocsp")
+		os.WriteFile(spec.OCSPPath, resp, 0600)
+
+		store, err := NewStore([]Spec{spec}, testLogger)
+		if c.fails {
+			if err == nil {
+				t.Errorf("Loading a mismatched OCSP response succeeded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to create store: %v \n", err)
+		}
+		stapled, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+		if (len(stapled.OCSPStaple) > 0) != c.stapled {
+			t.Errorf("OCSP staple present: %v, want %v", len(stapled.OCSPStaple) > 0, c.stapled)
+		}
+	}
+}
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs("a.pem:a.key, b.pem:b.key:b.ocsp")
+	if err != nil || len(specs) != 2 || specs[1].OCSPPath != "b.ocsp" {
+		t.Errorf("Unexpected specs: %+v - %v", specs, err)
+	}
+	if _, err := ParseSpecs("a.pem"); err == nil {
+		t.Errorf("Parsing succeeded without a key path")
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	if v, err := ParseMinVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("Unexpected version: %v - %v", v, err)
+	}
+	if _, err := ParseMinVersion("1.0"); err == nil {
+		t.Errorf("TLS 1.0 was accepted as minimum version")
+	}
+	suites, err := ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil || len(suites) != 2 {
+		t.Errorf("Unexpected cipher suites: %v - %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Errorf("Insecure cipher suite was accepted")
+	}
+}
@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// ErrUsage is returned for unknown commands and missing or malformed arguments
+var ErrUsage = errors.New("Invalid usage")
+
+// Usage lists the subcommands of the iotdashboard binary
+const Usage = `Usage: iotdashboard <command> [flags] [arguments]
+
+Commands:
+  serve                              start the web server (the default)
+  migrate                            create or update the database schema
+  user add [-role admin] <email>     add a user, prompting for the password
+  user invite [-role admin] <email>  email a single-use link to choose a password with
+  user list                          list all users
+  user disable <email>               stop a user from logging in, revoke their sessions and suspend their API keys
+  user enable <email>                let a disabled or deleted user log in again
+  user delete <email>                delete a user, who is purged after DELETED_RETENTION
+  user purge                         purge the users deleted more than DELETED_RETENTION ago
+  user set-password <email>          reset a user's password, prompting for the new one
+  user grant-role <email> <role>     set a user's role to "user" or "admin"
+  user set-username <email> [name]   set the username a user can log in with, or remove it
+  sessions revoke <email>            log a user out everywhere
+  keys rotate <email> <id>           replace an API key by a new secret
+
+Every command except serve accepts -json to print machine readable output.
+Passwords are read from the terminal, or from the first line of standard input when it is not a terminal.
+`
+
+// App runs administrative commands against the dashboard's database, sharing the server's configuration
+type App struct {
+	Ctrlr  *controller.ControllerService
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// ReadPassword prompts for a password. It defaults to reading from the terminal without echo.
+	ReadPassword func(prompt string) (string, error)
+
+	json bool
+}
+
+// RotatedKey is printed by keys rotate. Key holds the new secret, which cannot be retrieved again.
+type RotatedKey struct {
+	dbmanager.APIKey
+	Key string `json:"key"`
+}
+
+// Run executes the command given by args, e.g. ["user", "add", "e@example.com"]
+func (app *App) Run(ctx context.Context, args []string) error {
+	if app.ReadPassword == nil {
+		app.ReadPassword = app.readPassword
+	}
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	name := args[0]
+	if len(args) > 1 && (name == "user" || name == "sessions" || name == "keys") {
+		name += " " + args[1]
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&app.json, "json", false, "print JSON")
+	role := dbmanager.RoleUser
+	if name == "user add" || name == "user invite" {
+		fs.StringVar(&role, "role", dbmanager.RoleUser, "role of the new user")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	params := fs.Args()
+
+	switch {
+	case name == "migrate" && len(params) == 0:
+		// opening the database has already brought the schema up to date
+		return app.print(map[string]bool{"migrated": app.Ctrlr.PSQL.Migrated()}, "Database schema is up to date")
+	case name == "user add" && len(params) == 1:
+		password, err := app.newPassword()
+		if err != nil {
+			return err
+		}
+		if err := app.Ctrlr.AddUser(ctx, actor(), params[0], password, role, client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Added user")
+	case name == "user invite" && len(params) == 1:
+		if err := app.Ctrlr.InviteUser(ctx, actor(), params[0], role, client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Sent an invitation to")
+	case name == "user list" && len(params) == 0:
+		return app.listUsers(ctx)
+	case name == "user disable" && len(params) == 1:
+		if err := app.Ctrlr.DisableUser(ctx, actor(), params[0], client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Disabled user")
+	case name == "user enable" && len(params) == 1:
+		if err := app.Ctrlr.EnableUser(ctx, actor(), params[0], client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Enabled user")
+	case name == "user delete" && len(params) == 1:
+		if err := app.Ctrlr.DeleteUser(ctx, actor(), params[0], client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Deleted user")
+	case name == "user purge" && len(params) == 0:
+		n, err := app.Ctrlr.PurgeDeletedUsers(ctx)
+		if err != nil {
+			return err
+		}
+		return app.print(map[string]int{"purged": n}, fmt.Sprintf("Purged %d deleted users", n))
+	case name == "user set-password" && len(params) == 1:
+		password, err := app.newPassword()
+		if err != nil {
+			return err
+		}
+		if err := app.Ctrlr.ResetPassword(ctx, actor(), params[0], password, client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Set the password and revoked the sessions of")
+	case name == "user grant-role" && len(params) == 2:
+		if err := app.Ctrlr.SetUserRole(ctx, actor(), params[0], params[1], client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Granted "+params[1]+" role to")
+	case name == "user set-username" && (len(params) == 1 || len(params) == 2):
+		username := ""
+		if len(params) == 2 {
+			username = params[1]
+		}
+		if err := app.Ctrlr.SetUsername(ctx, actor(), params[0], username, client); err != nil {
+			return err
+		}
+		if username == "" {
+			return app.printUser(ctx, params[0], "Removed the username of")
+		}
+		return app.printUser(ctx, params[0], "Set the username of")
+	case name == "sessions revoke" && len(params) == 1:
+		if err := app.Ctrlr.RevokeSessions(ctx, actor(), params[0], client); err != nil {
+			return err
+		}
+		return app.printUser(ctx, params[0], "Revoked the sessions of")
+	case name == "keys rotate" && len(params) == 2:
+		id, err := strconv.Atoi(params[1])
+		if err != nil {
+			return fmt.Errorf("%w: invalid key id %q", ErrUsage, params[1])
+		}
+		token, key, err := app.Ctrlr.RotateAPIKey(ctx, params[0], id, client)
+		if err != nil {
+			return err
+		}
+		return app.print(RotatedKey{APIKey: key, Key: token},
+			fmt.Sprintf("Replaced key %d by key %d, expiring %s:\n%s", id, key.ID, key.Expires.Format(time.RFC3339), token))
+	}
+	return ErrUsage
+}
+
+// client identifies the command line in the audit log
+var client = controller.ClientInfo{UserAgent: "iotdashboard-cli"}
+
+// actor names the operating system user running a command, for the audit log
+func actor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func (app *App) listUsers(ctx context.Context) error {
+	users, err := app.Ctrlr.PSQL.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if app.json {
+		return json.NewEncoder(app.Stdout).Encode(users)
+	}
+	w := tabwriter.NewWriter(app.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tUSERNAME\tROLE\tSTATUS\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Email, u.Username, u.Role, u.Status, u.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// printUser prints the current state of a user as JSON, or message followed by the email otherwise
+func (app *App) printUser(ctx context.Context, email, message string) error {
+	if !app.json {
+		return app.print(nil, message+" "+email)
+	}
+	u, err := app.Ctrlr.PSQL.GetUser(ctx, email)
+	if err != nil {
+		return err
+	}
+	return app.print(u, "")
+}
+
+func (app *App) print(v interface{}, text string) error {
+	if app.json {
+		return json.NewEncoder(app.Stdout).Encode(v)
+	}
+	_, err := fmt.Fprintln(app.Stdout, text)
+	return err
+}
+
+// newPassword prompts for a password twice and returns it if both entries match
+func (app *App) newPassword() (string, error) {
+	password, err := app.ReadPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("Password must not be empty")
+	}
+	if !app.isTerminal() {
+		return password, nil
+	}
+	confirmation, err := app.ReadPassword("Repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if confirmation != password {
+		return "", errors.New("Passwords do not match")
+	}
+	return password, nil
+}
+
+func (app *App) isTerminal() bool {
+	f, ok := app.Stdin.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// readPassword reads a password from the terminal without echoing it, or a line from Stdin when piped
+func (app *App) readPassword(prompt string) (string, error) {
+	if app.isTerminal() {
+		fmt.Fprint(app.Stderr, prompt)
+		password, err := term.ReadPassword(int(app.Stdin.(*os.File).Fd()))
+		fmt.Fprintln(app.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(app.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("Reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,307 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"iotdashboard/metrics"
+	"iotdashboard/utils"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testLogger = utils.NewLogger(io.Discard, "text", slog.LevelInfo)
+
+var userColumns = []string{"uid", "email", "username", "role", "status", "verified_at", "created"}
+
+func newTestApp(t *testing.T) (*App, sqlmock.Sqlmock, *bytes.Buffer) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctrlr, err := controller.NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	ctrlr.PSQL.DB = db
+
+	stdout := new(bytes.Buffer)
+	app := &App{Ctrlr: ctrlr, Stdin: strings.NewReader(""), Stdout: stdout, Stderr: io.Discard}
+	return app, mock, stdout
+}
+
+func TestUsage(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	cases := [][]string{
+		{},
+		{"frobnicate"},
+		{"user"},
+		{"user", "add"},
+		{"user", "list", "extra"},
+		{"user", "list", "-role", "admin"},
+		{"keys", "rotate", "user@gmail.com", "one"},
+	}
+	for _, args := range cases {
+		if err := app.Run(context.Background(), args); !errors.Is(err, ErrUsage) {
+			t.Errorf("Running %q returned %v, want %v", args, err, ErrUsage)
+		}
+	}
+}
+
+func TestUserAdd(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+	var prompts []string
+	app.ReadPassword = func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		return "S3cure3Pa$$", nil
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password)")).WithArgs("admin@gmail.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET role = $2 WHERE email = $1;")).WithArgs("admin@gmail.com", "admin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_create", "admin@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin@gmail.com", "", "admin", "active", nil, time.Now()))
+
+	err := app.Run(context.Background(), []string{"user", "add", "-role", "admin", "-json", "admin@gmail.com"})
+	if err != nil {
+		t.Fatalf("Adding a user failed: %v \n", err)
+	}
+	var u dbmanager.User
+	if err := json.Unmarshal(stdout.Bytes(), &u); err != nil || u.Email != "admin@gmail.com" || u.Role != "admin" {
+		t.Errorf("Unexpected output %q: %v", stdout.String(), err)
+	}
+	if len(prompts) != 1 {
+		t.Errorf("Password was prompted for %d times without a terminal", len(prompts))
+	}
+
+	//an unknown role is rejected before anything is written
+	if err := app.Run(context.Background(), []string{"user", "add", "-role", "root", "root@gmail.com"}); err == nil {
+		t.Errorf("User was added with an unknown role")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserInvite(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+	app.Ctrlr.Invites = controller.InviteOptions{Mailer: &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WithArgs("admin@gmail.com", "admin", "invited").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations")).WithArgs("admin@gmail.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_invite", "admin@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := app.Run(context.Background(), []string{"user", "invite", "-role", "admin", "admin@gmail.com"}); err != nil {
+		t.Fatalf("Inviting a user failed: %v \n", err)
+	}
+	if !strings.Contains(stdout.String(), "admin@gmail.com") {
+		t.Errorf("Unexpected output %q", stdout.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReadPasswordFromStdin(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	app.Stdin = strings.NewReader("piped secret\r\nignored\n")
+
+	password, err := app.readPassword("Password: ")
+	if err != nil || password != "piped secret" {
+		t.Errorf("Read password %q: %v", password, err)
+	}
+}
+
+func TestUserList(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(userColumns).
+			AddRow(1, "admin@gmail.com", "", "admin", "active", nil, created).
+			AddRow(2, "user@gmail.com", "tech1", "user", "disabled", nil, created)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users ORDER BY uid")).WillReturnRows(rows())
+	if err := app.Run(context.Background(), []string{"user", "list"}); err != nil {
+		t.Fatalf("Listing users failed: %v \n", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[2], "tech1") || !strings.Contains(lines[2], "disabled") {
+		t.Errorf("Unexpected table:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users ORDER BY uid")).WillReturnRows(rows())
+	if err := app.Run(context.Background(), []string{"user", "list", "-json"}); err != nil {
+		t.Fatalf("Listing users failed: %v \n", err)
+	}
+	var users []dbmanager.User
+	if err := json.Unmarshal(stdout.Bytes(), &users); err != nil || len(users) != 2 || users[1].Status != dbmanager.StatusDisabled {
+		t.Errorf("Unexpected output %q: %v", stdout.String(), err)
+	}
+}
+
+func TestSessionsRevoke(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET sessions_revoked_at = $2 WHERE email = $1;")).
+		WithArgs("user@gmail.com", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("sessions_revoke", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"sessions", "revoke", "user@gmail.com"}); err != nil {
+		t.Fatalf("Revoking sessions failed: %v \n", err)
+	}
+	if !strings.Contains(stdout.String(), "user@gmail.com") {
+		t.Errorf("Unexpected output %q", stdout.String())
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET sessions_revoked_at = $2 WHERE email = $1;")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := app.Run(context.Background(), []string{"sessions", "revoke", "nobody@gmail.com"}); err != dbmanager.ErrUserNonexistant {
+		t.Errorf("Revoking the sessions of an unknown user returned %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserDeleteEnableAndPurge(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = $2, deleted_at = $3")).
+		WithArgs("user@gmail.com", "deleted", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE api_keys SET revoked_at")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM oauth_codes")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_delete", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"user", "delete", "user@gmail.com"}); err != nil {
+		t.Fatalf("Deleting user failed: %v \n", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = $2, deleted_at = NULL")).
+		WithArgs("user@gmail.com", "active", "disabled", "deleted").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_enable", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"user", "enable", "user@gmail.com"}); err != nil {
+		t.Fatalf("Enabling user failed: %v \n", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM users WHERE status = $1 AND deleted_at < $2 RETURNING email")).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("old@gmail.com"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_purge", "old@gmail.com", "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"user", "purge"}); err != nil {
+		t.Fatalf("Purging users failed: %v \n", err)
+	}
+
+	output := stdout.String()
+	for _, want := range []string{"Deleted user user@gmail.com", "Enabled user user@gmail.com", "Purged 1 deleted users"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q is missing %q", output, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserSetUsername(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET username = $2 WHERE email = $1;")).
+		WithArgs("user@gmail.com", sql.NullString{String: "tech1", Valid: true}).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("username_change", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"user", "set-username", "user@gmail.com", "Tech1"}); err != nil {
+		t.Fatalf("Setting a username failed: %v \n", err)
+	}
+	if !strings.Contains(stdout.String(), "user@gmail.com") {
+		t.Errorf("Unexpected output %q", stdout.String())
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET username = $2 WHERE email = $1;")).
+		WithArgs("user@gmail.com", sql.NullString{}).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("username_change", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := app.Run(context.Background(), []string{"user", "set-username", "user@gmail.com"}); err != nil {
+		t.Fatalf("Removing a username failed: %v \n", err)
+	}
+
+	if err := app.Run(context.Background(), []string{"user", "set-username", "user@gmail.com", "root"}); !errors.Is(err, dbmanager.ErrReservedUsername) {
+		t.Errorf("Setting a reserved username returned %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestKeysRotate(t *testing.T) {
+	app, mock, stdout := newTestApp(t)
+	created := time.Now().Add(-time.Hour).UTC()
+	expires := created.Add(30 * 24 * time.Hour)
+
+	columns := []string{"id", "email", "role", "name", "prefix", "scopes", "expires", "last_used", "created"}
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE k.email = $1")).WithArgs("user@gmail.com").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(3, "user@gmail.com", "user", "ci", "iotd_abcdefgh", "keys:read", expires, nil, created))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO api_keys")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("api_key_create", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE api_keys SET revoked_at")).WithArgs(3, "user@gmail.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("api_key_revoke", "user@gmail.com", "", "iotdashboard-cli", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := app.Run(context.Background(), []string{"keys", "rotate", "-json", "user@gmail.com", "3"}); err != nil {
+		t.Fatalf("Rotating a key failed: %v \n", err)
+	}
+	var rotated RotatedKey
+	if err := json.Unmarshal(stdout.Bytes(), &rotated); err != nil || rotated.ID != 4 || !controller.IsAPIKey(rotated.Key) || rotated.Name != "ci" {
+		t.Fatalf("Unexpected output %q: %v \n", stdout.String(), err)
+	}
+	if lifetime := rotated.Expires.Sub(rotated.Created); lifetime < expires.Sub(created)-time.Minute || lifetime > expires.Sub(created)+time.Minute {
+		t.Errorf("Rotated key lives for %v, want %v", lifetime, expires.Sub(created))
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE k.email = $1")).WillReturnRows(sqlmock.NewRows(columns))
+	if err := app.Run(context.Background(), []string{"keys", "rotate", "user@gmail.com", "9"}); err != dbmanager.ErrAPIKeyNonexistant {
+		t.Errorf("Rotating an unknown key returned %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
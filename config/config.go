@@ -0,0 +1,409 @@
+package config
+
+import (
+	"fmt"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"iotdashboard/passwords"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the dashboard server
+type Config struct {
+	// HTTPAddr only redirects to HTTPSAddr
+	HTTPAddr  string
+	HTTPSAddr string
+	// AdminAddr serves metrics and health checks over plain HTTP. Empty disables the admin listener.
+	AdminAddr string
+	CertPath  string
+	KeyPath   string
+	// OCSPPath is an optional DER encoded OCSP response stapled to the certificate at CertPath
+	OCSPPath string
+	// ExtraCerts are further certificates selected by SNI, as a comma separated list of cert.pem:key.pem[:ocsp.der]
+	ExtraCerts string
+	// TLSMinVersion is "1.2" or "1.3"
+	TLSMinVersion string
+	// TLSCipherSuites is a comma separated list of TLS 1.2 cipher suite names. Empty uses Go's defaults.
+	TLSCipherSuites string
+	// TLSClientCA is a PEM bundle of CAs whose client certificates authenticate devices and services. Empty disables mutual TLS.
+	TLSClientCA string
+	// CertReloadInterval is how often the certificate files are checked for changes
+	CertReloadInterval time.Duration
+
+	// ACMEDomains is a comma separated list of host names to obtain certificates for automatically. Empty disables ACME.
+	ACMEDomains      string
+	ACMEDirectoryURL string
+	ACMEEmail        string
+	ACMECacheDir     string
+	// ACMECABundle holds extra roots trusted for the ACME server, e.g. a local Pebble instance
+	ACMECABundle string
+
+	LogFormat string
+	LogLevel  string
+	// TraceExporter is "otlp", "stdout", "file" or "none"
+	TraceExporter string
+	// TraceFile receives the spans when TraceExporter is "file"
+	TraceFile string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are given to finish on shutdown
+	ShutdownTimeout time.Duration
+	// JanitorInterval is how often expired tokens are purged from the logout blocklist
+	JanitorInterval time.Duration
+	// IntrospectCacheTTL caps how long downstream services may cache /introspect responses
+	IntrospectCacheTTL time.Duration
+
+	// DatabaseURL is a postgres:// URL or key=value connection string. When set, it replaces DBHost through DBSSLKey.
+	DatabaseURL string
+	DBHost      string
+	DBPort      string
+	DBUser      string
+	DBPassword  string
+	DBName      string
+	// DBSSLMode is "disable", "require", "verify-ca" or "verify-full"
+	DBSSLMode string
+	// DBSSLRootCert is a PEM bundle of CAs trusted for the Postgres server certificate
+	DBSSLRootCert string
+	// DBSSLCert and DBSSLKey are an optional client certificate presented to Postgres
+	DBSSLCert         string
+	DBSSLKey          string
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	// DBStartupTimeout is how long the first database connection is retried before the server gives up
+	DBStartupTimeout time.Duration
+	// DBQueryTimeout bounds each database operation so a stalled database cannot hold requests indefinitely
+	DBQueryTimeout time.Duration
+
+	// PasswordHash is the algorithm of new password hashes, "bcrypt" or "argon2id"
+	PasswordHash string
+	BcryptCost   int
+	// Argon2Memory is in KiB
+	Argon2Memory  int
+	Argon2Time    int
+	Argon2Threads int
+	// LockoutThreshold is how many wrong passwords in a row lock an account for LockoutDuration. Zero disables lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// HashConcurrency is how many passwords are hashed or verified at once, and HashQueue how many more may wait
+	// before requests are turned away with 503. Zero picks a value from the number of CPUs.
+	HashConcurrency int
+	HashQueue       int
+	// DeletedRetention is how long deleted users are kept before they are purged, checked every PurgeInterval.
+	// A PurgeInterval of zero disables purging.
+	DeletedRetention time.Duration
+	PurgeInterval    time.Duration
+
+	// BootstrapAdminEmail and BootstrapAdminPassword create the first admin on a fresh database.
+	// Without them, a one-time token for /setup is logged instead.
+	BootstrapAdminEmail    string
+	BootstrapAdminPassword string
+
+	// PublicURL is the address users reach the dashboard at, used in links sent by email
+	PublicURL string
+	// InviteTTL is how long an invitation link can be used
+	InviteTTL time.Duration
+	// MailSender is "smtp", "file" or "none"
+	MailSender string
+	MailFrom   string
+	// MailDir receives the messages as .eml files when MailSender is "file"
+	MailDir      string
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+
+	// RegistrationMode is "disabled", "open" or "approval"
+	RegistrationMode string
+	// RegistrationDomains is a comma separated list of email domains that may register. Empty allows every domain.
+	RegistrationDomains string
+	// RegistrationRateLimit is how many registrations a client IP may attempt per hour
+	RegistrationRateLimit int
+
+	// CookieDomain is set on the JWT cookie so it reaches other hosts behind forward authentication. Empty keeps it host-only.
+	CookieDomain string
+	// LoginURL is where /auth/verify sends unauthenticated users
+	LoginURL string
+	// ForwardAuthDomains is a comma separated list of domains, including their subdomains, that users may be sent back to after logging in
+	ForwardAuthDomains string
+}
+
+// Default returns the configuration used when no environment variables are set
+func Default() Config {
+	return Config{
+		HTTPAddr:  ":8080",
+		HTTPSAddr: ":9090",
+		AdminAddr: ":9091",
+		CertPath:  "server-cert.pem",
+		KeyPath:   "server-key.pem",
+
+		TLSMinVersion:      "1.2",
+		CertReloadInterval: 30 * time.Second,
+		ACMECacheDir:       "acme-cache",
+
+		LogFormat: "text",
+		LogLevel:  "info",
+
+		TraceExporter: "none",
+		TraceFile:     "traces.json",
+
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   15 * time.Second,
+		JanitorInterval:   time.Minute,
+
+		IntrospectCacheTTL: 30 * time.Second,
+
+		DBHost:            "db",
+		DBPort:            "5432",
+		DBUser:            "postgres",
+		DBPassword:        "postgres",
+		DBName:            "iot_dashboard",
+		DBSSLMode:         "disable",
+		DBMaxOpenConns:    25,
+		DBMaxIdleConns:    5,
+		DBConnMaxLifetime: 30 * time.Minute,
+		DBConnMaxIdleTime: 5 * time.Minute,
+		DBStartupTimeout:  time.Minute,
+		DBQueryTimeout:    5 * time.Second,
+
+		PasswordHash:  passwords.AlgorithmBcrypt,
+		BcryptCost:    passwords.DefaultBcryptCost,
+		Argon2Memory:  int(passwords.DefaultArgon2id().Memory),
+		Argon2Time:    int(passwords.DefaultArgon2id().Time),
+		Argon2Threads: int(passwords.DefaultArgon2id().Threads),
+
+		LockoutThreshold: 5,
+		LockoutDuration:  15 * time.Minute,
+		DeletedRetention: controller.DefaultDeletedRetention,
+		PurgeInterval:    time.Hour,
+
+		PublicURL:  "https://localhost:9090",
+		InviteTTL:  controller.DefaultInviteTTL,
+		MailSender: "file",
+		MailFrom:   "IoT Dashboard <noreply@localhost>",
+		MailDir:    "mail",
+
+		RegistrationMode:      controller.RegistrationDisabled,
+		RegistrationRateLimit: 5,
+
+		LoginURL: "/",
+	}
+}
+
+// Database returns the Postgres connection settings of cfg
+func (cfg Config) Database() (dbmanager.Options, error) {
+	hasher, err := cfg.Hasher()
+	if err != nil {
+		return dbmanager.Options{}, err
+	}
+	return dbmanager.Options{
+		DSN:              cfg.DatabaseURL,
+		Host:             cfg.DBHost,
+		Port:             cfg.DBPort,
+		User:             cfg.DBUser,
+		Password:         cfg.DBPassword,
+		Name:             cfg.DBName,
+		SSLMode:          cfg.DBSSLMode,
+		SSLRootCert:      cfg.DBSSLRootCert,
+		SSLCert:          cfg.DBSSLCert,
+		SSLKey:           cfg.DBSSLKey,
+		MaxOpenConns:     cfg.DBMaxOpenConns,
+		MaxIdleConns:     cfg.DBMaxIdleConns,
+		ConnMaxLifetime:  cfg.DBConnMaxLifetime,
+		ConnMaxIdleTime:  cfg.DBConnMaxIdleTime,
+		StartupTimeout:   cfg.DBStartupTimeout,
+		QueryTimeout:     cfg.DBQueryTimeout,
+		Hasher:           hasher,
+		LockoutThreshold: cfg.LockoutThreshold,
+		LockoutDuration:  cfg.LockoutDuration,
+		HashConcurrency:  cfg.HashConcurrency,
+		HashQueue:        cfg.HashQueue,
+	}, nil
+}
+
+// Hasher returns the hasher of new passwords
+func (cfg Config) Hasher() (passwords.Hasher, error) {
+	if cfg.Argon2Memory < 0 || cfg.Argon2Time < 0 || cfg.Argon2Threads < 0 || cfg.Argon2Threads > 255 {
+		return nil, fmt.Errorf("Invalid Argon2 parameters m=%d,t=%d,p=%d", cfg.Argon2Memory, cfg.Argon2Time, cfg.Argon2Threads)
+	}
+	hasher, err := passwords.New(passwords.Config{
+		Algorithm:     cfg.PasswordHash,
+		BcryptCost:    cfg.BcryptCost,
+		Argon2Memory:  uint32(cfg.Argon2Memory),
+		Argon2Time:    uint32(cfg.Argon2Time),
+		Argon2Threads: uint8(cfg.Argon2Threads),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PASSWORD_HASH settings: %w", err)
+	}
+	return hasher, nil
+}
+
+// Invites returns the settings of invitation emails, with the configured mail sender
+func (cfg Config) Invites() (controller.InviteOptions, error) {
+	sender, err := mailer.New(mailer.Config{
+		Kind:         cfg.MailSender,
+		From:         cfg.MailFrom,
+		Dir:          cfg.MailDir,
+		SMTPAddr:     cfg.SMTPAddr,
+		SMTPUser:     cfg.SMTPUser,
+		SMTPPassword: cfg.SMTPPassword,
+	})
+	if err != nil {
+		return controller.InviteOptions{}, err
+	}
+	return controller.InviteOptions{Mailer: sender, BaseURL: cfg.PublicURL, TTL: cfg.InviteTTL}, nil
+}
+
+// Registration returns the self-registration settings of cfg
+func (cfg Config) Registration() (controller.RegistrationOptions, error) {
+	switch cfg.RegistrationMode {
+	case controller.RegistrationDisabled, controller.RegistrationOpen, controller.RegistrationApproval:
+	default:
+		return controller.RegistrationOptions{}, fmt.Errorf("Unknown registration mode %q", cfg.RegistrationMode)
+	}
+	opts := controller.RegistrationOptions{Mode: cfg.RegistrationMode}
+	for _, domain := range strings.Split(cfg.RegistrationDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain == "" {
+			continue
+		}
+		normalized, err := dbmanager.NormalizeDomain(domain)
+		if err != nil {
+			return controller.RegistrationOptions{}, fmt.Errorf("Invalid registration domain %q: %v", domain, err)
+		}
+		opts.Domains = append(opts.Domains, normalized)
+	}
+	return opts, nil
+}
+
+// FromEnv returns the default configuration overridden by any environment variables that are set.
+// Durations use the time.ParseDuration syntax, e.g. "30s".
+func FromEnv() (Config, error) {
+	cfg := Default()
+	lookup(&cfg.HTTPAddr, "HTTP_ADDR")
+	lookup(&cfg.HTTPSAddr, "HTTPS_ADDR")
+	lookup(&cfg.AdminAddr, "ADMIN_ADDR")
+	lookup(&cfg.CertPath, "TLS_CERT")
+	lookup(&cfg.KeyPath, "TLS_KEY")
+	lookup(&cfg.OCSPPath, "TLS_OCSP")
+	lookup(&cfg.ExtraCerts, "TLS_EXTRA_CERTS")
+	lookup(&cfg.TLSMinVersion, "TLS_MIN_VERSION")
+	lookup(&cfg.TLSCipherSuites, "TLS_CIPHER_SUITES")
+	lookup(&cfg.TLSClientCA, "TLS_CLIENT_CA")
+	lookup(&cfg.ACMEDomains, "ACME_DOMAINS")
+	lookup(&cfg.ACMEDirectoryURL, "ACME_DIRECTORY_URL")
+	lookup(&cfg.ACMEEmail, "ACME_EMAIL")
+	lookup(&cfg.ACMECacheDir, "ACME_CACHE_DIR")
+	lookup(&cfg.ACMECABundle, "ACME_CA_BUNDLE")
+	lookup(&cfg.LogFormat, "LOG_FORMAT")
+	lookup(&cfg.LogLevel, "LOG_LEVEL")
+	lookup(&cfg.TraceExporter, "TRACE_EXPORTER")
+	lookup(&cfg.TraceFile, "TRACE_FILE")
+	lookup(&cfg.DatabaseURL, "DATABASE_URL")
+	lookup(&cfg.DBHost, "DB_HOST")
+	lookup(&cfg.DBPort, "DB_PORT")
+	lookup(&cfg.DBUser, "DB_USER")
+	lookup(&cfg.DBPassword, "DB_PASSWORD")
+	lookup(&cfg.DBName, "DB_NAME")
+	lookup(&cfg.DBSSLMode, "DB_SSLMODE")
+	lookup(&cfg.DBSSLRootCert, "DB_SSLROOTCERT")
+	lookup(&cfg.DBSSLCert, "DB_SSLCERT")
+	lookup(&cfg.DBSSLKey, "DB_SSLKEY")
+	lookup(&cfg.PasswordHash, "PASSWORD_HASH")
+	lookup(&cfg.BootstrapAdminEmail, "BOOTSTRAP_ADMIN_EMAIL")
+	lookup(&cfg.BootstrapAdminPassword, "BOOTSTRAP_ADMIN_PASSWORD")
+	lookup(&cfg.PublicURL, "PUBLIC_URL")
+	lookup(&cfg.MailSender, "MAIL_SENDER")
+	lookup(&cfg.MailFrom, "MAIL_FROM")
+	lookup(&cfg.MailDir, "MAIL_DIR")
+	lookup(&cfg.SMTPAddr, "SMTP_ADDR")
+	lookup(&cfg.SMTPUser, "SMTP_USER")
+	lookup(&cfg.SMTPPassword, "SMTP_PASSWORD")
+	lookup(&cfg.RegistrationMode, "REGISTRATION")
+	lookup(&cfg.RegistrationDomains, "REGISTRATION_DOMAINS")
+	lookup(&cfg.CookieDomain, "COOKIE_DOMAIN")
+	lookup(&cfg.LoginURL, "LOGIN_URL")
+	lookup(&cfg.ForwardAuthDomains, "FORWARD_AUTH_DOMAINS")
+
+	for key, field := range map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT":  &cfg.ReadHeaderTimeout,
+		"READ_TIMEOUT":         &cfg.ReadTimeout,
+		"WRITE_TIMEOUT":        &cfg.WriteTimeout,
+		"IDLE_TIMEOUT":         &cfg.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":     &cfg.ShutdownTimeout,
+		"JANITOR_INTERVAL":     &cfg.JanitorInterval,
+		"CERT_RELOAD_INTERVAL": &cfg.CertReloadInterval,
+		"INTROSPECT_CACHE_TTL": &cfg.IntrospectCacheTTL,
+		"DB_QUERY_TIMEOUT":     &cfg.DBQueryTimeout,
+		"DB_CONN_MAX_LIFETIME": &cfg.DBConnMaxLifetime,
+		"DB_CONN_MAX_IDLE":     &cfg.DBConnMaxIdleTime,
+		"DB_STARTUP_TIMEOUT":   &cfg.DBStartupTimeout,
+		"INVITE_TTL":           &cfg.InviteTTL,
+		"LOCKOUT_DURATION":     &cfg.LockoutDuration,
+		"DELETED_RETENTION":    &cfg.DeletedRetention,
+		"PURGE_INTERVAL":       &cfg.PurgeInterval,
+	} {
+		if err := lookupDuration(field, key); err != nil {
+			return cfg, err
+		}
+	}
+	for key, field := range map[string]*int{
+		"DB_MAX_OPEN_CONNS":       &cfg.DBMaxOpenConns,
+		"DB_MAX_IDLE_CONNS":       &cfg.DBMaxIdleConns,
+		"REGISTRATION_RATE_LIMIT": &cfg.RegistrationRateLimit,
+		"BCRYPT_COST":             &cfg.BcryptCost,
+		"ARGON2_MEMORY":           &cfg.Argon2Memory,
+		"ARGON2_TIME":             &cfg.Argon2Time,
+		"ARGON2_THREADS":          &cfg.Argon2Threads,
+		"LOCKOUT_THRESHOLD":       &cfg.LockoutThreshold,
+		"HASH_CONCURRENCY":        &cfg.HashConcurrency,
+		"HASH_QUEUE":              &cfg.HashQueue,
+	} {
+		if err := lookupInt(field, key); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+func lookup(field *string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*field = v
+	}
+}
+
+func lookupDuration(field *time.Duration, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %v", key, err)
+	}
+	*field = d
+	return nil
+}
+
+func lookupInt(field *int, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %v", key, err)
+	}
+	*field = n
+	return nil
+}
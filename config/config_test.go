@@ -0,0 +1,101 @@
+package config
+
+import (
+	"iotdashboard/passwords"
+	"testing"
+	"time"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("HTTPS_ADDR", ":443")
+	t.Setenv("ADMIN_ADDR", "")
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("SHUTDOWN_TIMEOUT", "3s")
+	t.Setenv("DB_MAX_OPEN_CONNS", "50")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v \n", err)
+	}
+	if cfg.HTTPSAddr != ":443" || cfg.LogFormat != "json" {
+		t.Errorf("Environment variables were not applied: %+v", cfg)
+	}
+	if cfg.ShutdownTimeout != 3*time.Second {
+		t.Errorf("Duration environment variable was not applied: %+v", cfg)
+	}
+	if cfg.DBMaxOpenConns != 50 {
+		t.Errorf("Integer environment variable was not applied: %+v", cfg)
+	}
+	if cfg.AdminAddr != "" {
+		t.Errorf("An empty environment variable should disable the admin listener: %+v", cfg)
+	}
+	if cfg.HTTPAddr != Default().HTTPAddr {
+		t.Errorf("Unset environment variables should keep their default: %+v", cfg)
+	}
+}
+
+func TestFromEnvInvalidDuration(t *testing.T) {
+	t.Setenv("WRITE_TIMEOUT", "forever")
+
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("Loading succeeded with an invalid duration")
+	}
+}
+
+func TestFromEnvInvalidInt(t *testing.T) {
+	t.Setenv("DB_MAX_IDLE_CONNS", "plenty")
+
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("Loading succeeded with an invalid integer")
+	}
+}
+
+func TestInvites(t *testing.T) {
+	cfg := Default()
+	if _, err := cfg.Invites(); err != nil {
+		t.Errorf("Default mail configuration is invalid: %v", err)
+	}
+	cfg.MailSender = "smtp"
+	if _, err := cfg.Invites(); err == nil {
+		t.Errorf("SMTP was accepted without a server")
+	}
+}
+
+func TestHasher(t *testing.T) {
+	cfg := Default()
+	if h, err := cfg.Hasher(); err != nil || h != (passwords.Bcrypt{Cost: 10}) {
+		t.Errorf("Default hasher is %+v: %v", h, err)
+	}
+	cfg.PasswordHash = "argon2id"
+	cfg.Argon2Memory, cfg.Argon2Time, cfg.Argon2Threads = 19456, 2, 1
+	if h, err := cfg.Hasher(); err != nil || h != (passwords.Argon2id{Memory: 19456, Time: 2, Threads: 1}) {
+		t.Errorf("Configured hasher is %+v: %v", h, err)
+	}
+	cfg.Argon2Threads = 256
+	if _, err := cfg.Hasher(); err == nil {
+		t.Errorf("Too many Argon2 threads were accepted")
+	}
+	cfg.PasswordHash = "sha1"
+	if _, err := cfg.Database(); err == nil {
+		t.Errorf("Unknown password hash was accepted")
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	cfg := Default()
+	cfg.RegistrationMode = "approval"
+	cfg.RegistrationDomains = " Example.com,,iot.internal,Bücher.de "
+	opts, err := cfg.Registration()
+	if err != nil || len(opts.Domains) != 3 || opts.Domains[0] != "example.com" || opts.Domains[1] != "iot.internal" ||
+		opts.Domains[2] != "xn--bcher-kva.de" {
+		t.Errorf("Unexpected registration settings %+v: %v", opts, err)
+	}
+	cfg.RegistrationDomains = "exa mple.com"
+	if _, err := cfg.Registration(); err == nil {
+		t.Errorf("Invalid registration domain was accepted")
+	}
+	cfg.RegistrationMode = "anyone"
+	if _, err := cfg.Registration(); err == nil {
+		t.Errorf("Unknown registration mode was accepted")
+	}
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"iotdashboard/tracing"
+	"iotdashboard/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// APIKeyPrefix starts every API key, so keys can be told apart from JWTs and found by secret scanners
+const APIKeyPrefix = "iotd_"
+
+// MaxAPIKeyLifetime bounds how long an API key can be valid for
+const MaxAPIKeyLifetime = 365 * 24 * time.Hour
+
+// IsAPIKey reports whether a bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// hashToken hashes a high-entropy secret for storage. A fast hash suffices as such secrets cannot be guessed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrScopeNotHeld is returned when a credential asks for an API key with a scope it does not grant itself
+var ErrScopeNotHeld = errors.New("Cannot grant a scope the credential does not hold")
+
+// CreateAPIKey issues a named key for the subject of owner, the credential the request was made with, limited to
+// scopes and valid for ttl. A scoped credential cannot create keys with scopes beyond its own.
+// The returned secret is not stored and cannot be retrieved again.
+func (ct *ControllerService) CreateAPIKey(ctx context.Context, owner *utils.Claims, name string, scopes []string, ttl time.Duration, client ClientInfo) (_ string, _ dbmanager.APIKey, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.CreateAPIKey")
+	defer func() { tracing.End(span, err) }()
+
+	if name == "" || len(name) > 128 {
+		return "", dbmanager.APIKey{}, errors.New("API key name must be between 1 and 128 characters")
+	}
+	if len(scopes) == 0 {
+		return "", dbmanager.APIKey{}, errors.New("API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(dbmanager.Scopes, scope) {
+			return "", dbmanager.APIKey{}, fmt.Errorf("Unknown scope %q", scope)
+		}
+		if !owner.HasScope(scope) {
+			return "", dbmanager.APIKey{}, fmt.Errorf("%w: %q", ErrScopeNotHeld, scope)
+		}
+	}
+	if ttl <= 0 || ttl > MaxAPIKeyLifetime {
+		return "", dbmanager.APIKey{}, fmt.Errorf("API key lifetime must be positive and at most %v", MaxAPIKeyLifetime)
+	}
+
+	secret, err := ct.TokenUtil.GenerateRandomString(40)
+	if err != nil {
+		return "", dbmanager.APIKey{}, err
+	}
+	email := owner.Subject
+	token := APIKeyPrefix + secret
+	expires := time.Now().Add(ttl).UTC()
+	key := dbmanager.APIKey{
+		Email:   email,
+		Name:    name,
+		Prefix:  token[:len(APIKeyPrefix)+8],
+		Scopes:  scopes,
+		Expires: &expires,
+		Created: time.Now().UTC(),
+	}
+	key.ID, err = ct.PSQL.AddAPIKey(ctx, key, hashToken(token))
+	if err != nil {
+		return "", dbmanager.APIKey{}, err
+	}
+	ct.audit(ctx, dbmanager.AuditAPIKeyCreate, email, client, fmt.Sprintf("%s (%s)", key.Name, key.Prefix))
+	return token, key, nil
+}
+
+// AuthenticateAPIKey returns the claims of a valid API key, carrying the owner's role and the key's scopes,
+// and records that the key was used
+func (ct *ControllerService) AuthenticateAPIKey(ctx context.Context, token string) (_ *utils.Claims, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.AuthenticateAPIKey")
+	defer func() { tracing.End(span, err) }()
+
+	key, err := ct.PSQL.GetAPIKeyByHash(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if key.Expires != nil && key.Expires.Before(time.Now()) {
+		return nil, utils.ErrExpiredToken
+	}
+	if err := ct.PSQL.TouchAPIKey(ctx, key.ID); err != nil {
+		ct.Logger.ErrorContext(ctx, "Failed to record API key use", "prefix", key.Prefix, "error", err)
+	}
+
+	claims := &utils.Claims{
+		Role:  key.Role,
+		Scope: strings.Join(key.Scopes, " "),
+		StandardClaims: jwt.StandardClaims{
+			Id:       "apikey:" + strconv.Itoa(key.ID),
+			Subject:  key.Email,
+			IssuedAt: key.Created.Unix(),
+		},
+	}
+	if key.Expires != nil {
+		claims.ExpiresAt = key.Expires.Unix()
+	}
+	return claims, nil
+}
+
+// ListAPIKeys returns a user's active keys without their secrets
+func (ct *ControllerService) ListAPIKeys(ctx context.Context, email string) ([]dbmanager.APIKey, error) {
+	return ct.PSQL.ListAPIKeys(ctx, email)
+}
+
+// RotateAPIKey replaces one of a user's keys by a new secret with the same name, scopes and lifetime.
+// The old key is only revoked once its replacement has been stored.
+func (ct *ControllerService) RotateAPIKey(ctx context.Context, email string, id int, client ClientInfo) (string, dbmanager.APIKey, error) {
+	keys, err := ct.PSQL.ListAPIKeys(ctx, email)
+	if err != nil {
+		return "", dbmanager.APIKey{}, err
+	}
+	i := slices.IndexFunc(keys, func(key dbmanager.APIKey) bool { return key.ID == id })
+	if i < 0 {
+		return "", dbmanager.APIKey{}, dbmanager.ErrAPIKeyNonexistant
+	}
+	// the stored, normalized address, whatever case the caller used
+	email = keys[i].Email
+	ttl := MaxAPIKeyLifetime
+	if keys[i].Expires != nil {
+		ttl = min(keys[i].Expires.Sub(keys[i].Created), MaxAPIKeyLifetime)
+	}
+	// the owner rotates with their full authority, which includes every scope the key had
+	owner := &utils.Claims{StandardClaims: jwt.StandardClaims{Subject: email}}
+	token, key, err := ct.CreateAPIKey(ctx, owner, keys[i].Name, keys[i].Scopes, ttl, client)
+	if err != nil {
+		return "", dbmanager.APIKey{}, err
+	}
+	if err := ct.RevokeAPIKey(ctx, email, id, client); err != nil {
+		return "", dbmanager.APIKey{}, err
+	}
+	return token, key, nil
+}
+
+// RevokeAPIKey revokes one of a user's keys so it is rejected from then on
+func (ct *ControllerService) RevokeAPIKey(ctx context.Context, email string, id int, client ClientInfo) error {
+	err := ct.PSQL.RevokeAPIKey(ctx, email, id)
+	if err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditAPIKeyRevoke, email, client, "id "+strconv.Itoa(id))
+	return nil
+}
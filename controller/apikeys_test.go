@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"iotdashboard/utils"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestCreateAndAuthenticateAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	owner := &utils.Claims{StandardClaims: jwt.StandardClaims{Subject: "user@gmail.com"}}
+	invalid := []struct {
+		name   string
+		scopes []string
+		ttl    time.Duration
+	}{
+		{"", []string{"keys:read"}, time.Hour},
+		{"ci", nil, time.Hour},
+		{"ci", []string{"everything"}, time.Hour},
+		{"ci", []string{"keys:read"}, 0},
+		{"ci", []string{"keys:read"}, 2 * MaxAPIKeyLifetime},
+	}
+	for _, c := range invalid {
+		if _, _, err := controller.CreateAPIKey(context.Background(), owner, c.name, c.scopes, c.ttl, testClient); err == nil {
+			t.Errorf("Created an invalid API key: %+v", c)
+		}
+	}
+	//a key that may only manage keys cannot hand out other scopes
+	scoped := &utils.Claims{Scope: "keys:write", StandardClaims: owner.StandardClaims}
+	if _, _, err := controller.CreateAPIKey(context.Background(), scoped, "ci", []string{"keys:write", "audit:read"}, time.Hour, testClient); !errors.Is(err, ErrScopeNotHeld) {
+		t.Errorf("Creating a key with a scope the credential lacks returned %v, want %v", err, ErrScopeNotHeld)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO api_keys")).
+		WithArgs("user@gmail.com", "ci", sqlmock.AnyArg(), sqlmock.AnyArg(), "audit:read keys:read", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("api_key_create", "user@gmail.com", testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, key, err := controller.CreateAPIKey(context.Background(), owner, "ci", []string{"audit:read", "keys:read"}, time.Hour, testClient)
+	if err != nil {
+		t.Fatalf("Creating API key failed: %v \n", err)
+	}
+	if !IsAPIKey(token) || !strings.HasPrefix(token, key.Prefix) || key.ID != 7 {
+		t.Errorf("Unexpected key %+v for token %s", key, token)
+	}
+
+	columns := []string{"id", "email", "role", "name", "prefix", "scopes", "expires", "last_used", "created"}
+	query := regexp.QuoteMeta("FROM api_keys k JOIN users u ON u.email = k.email")
+	mock.ExpectQuery(query).WithArgs(hashToken(token)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "user@gmail.com", "admin", "ci", key.Prefix, "audit:read keys:read", *key.Expires, nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE api_keys SET last_used")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	claims, err := controller.AuthenticateAPIKey(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Authenticating API key failed: %v \n", err)
+	}
+	if claims.Subject != "user@gmail.com" || claims.Role != "admin" || !claims.HasScope("audit:read") || claims.HasScope("keys:write") {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	//expired keys are rejected without being touched
+	mock.ExpectQuery(query).WithArgs(hashToken(token)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "user@gmail.com", "admin", "ci", key.Prefix, "keys:read", time.Now().Add(-time.Minute), nil, time.Now()))
+	if _, err := controller.AuthenticateAPIKey(context.Background(), token); err != utils.ErrExpiredToken {
+		t.Errorf("Expected ErrExpiredToken for an expired key, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"iotdashboard/tracing"
+)
+
+// MinPasswordLength is the shortest password accepted for the initial admin and invited users
+const MinPasswordLength = 8
+
+// ErrInvalidAdmin is returned when the email or password of the initial admin is not acceptable
+var ErrInvalidAdmin = errors.New("Invalid initial admin")
+
+// ErrInvalidSetupToken is returned when /setup is called with a wrong token, or when no token was issued
+var ErrInvalidSetupToken = errors.New("Invalid setup token")
+
+// former default account, seeded with a well-known password before bootstrap existed
+const legacyEmail, legacyPassword = "e@g.c", "test"
+
+// Bootstrap prepares a first run. While no admin has been created, the admin given by email and password is created
+// right away; without one, a one-time setup token is returned, to be logged and redeemed through CompleteSetup.
+// It returns "" once bootstrap has completed.
+func (ct *ControllerService) Bootstrap(ctx context.Context, email, password string, client ClientInfo) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Bootstrap")
+	defer func() { tracing.End(span, err) }()
+
+	pending, err := ct.PSQL.BootstrapPending(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !pending {
+		// a login attempt would count towards locking the account on every start
+		if ok, _ := ct.PSQL.PasswordMatches(ctx, legacyEmail, legacyPassword); ok {
+			ct.Logger.WarnContext(ctx, "The former default account still has its well-known password, change it or disable the account", "email", legacyEmail)
+		}
+		return "", nil
+	}
+	if email != "" {
+		return "", ct.bootstrapAdmin(ctx, email, password, client, "from configuration")
+	}
+
+	token, err := ct.TokenUtil.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	ct.setupMu.Lock()
+	ct.setupTokenHash = hashToken(token)
+	ct.setupMu.Unlock()
+	return token, nil
+}
+
+// SetupPending reports whether a setup token has been issued and not redeemed yet
+func (ct *ControllerService) SetupPending() bool {
+	ct.setupMu.Lock()
+	defer ct.setupMu.Unlock()
+	return ct.setupTokenHash != ""
+}
+
+// CompleteSetup redeems the setup token issued by Bootstrap by creating the first admin.
+// The token can be used once; bootstrap is disabled for good afterwards.
+func (ct *ControllerService) CompleteSetup(ctx context.Context, token, email, password string, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.CompleteSetup")
+	defer func() { tracing.End(span, err) }()
+
+	ct.setupMu.Lock()
+	defer ct.setupMu.Unlock()
+	if ct.setupTokenHash == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(ct.setupTokenHash)) != 1 {
+		ct.Logger.WarnContext(ctx, "Setup attempted with an invalid token", "ip", client.IP)
+		return ErrInvalidSetupToken
+	}
+	err = ct.bootstrapAdmin(ctx, email, password, client, "through /setup")
+	if err == nil || err == dbmanager.ErrBootstrapDone {
+		ct.setupTokenHash = ""
+	}
+	return err
+}
+
+func (ct *ControllerService) bootstrapAdmin(ctx context.Context, email, password string, client ClientInfo, reason string) error {
+	email, err := dbmanager.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAdmin, err)
+	}
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("%w: password must be at least %d characters", ErrInvalidAdmin, MinPasswordLength)
+	}
+	if err := ct.PSQL.BootstrapAdmin(ctx, email, password); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditUserCreate, email, client, "initial admin "+reason)
+	return nil
+}
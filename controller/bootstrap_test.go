@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"iotdashboard/passwords"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBootstrap(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	expectPending := func(pending bool) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT NOT EXISTS (SELECT 1 FROM bootstrap)")).
+			WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(pending))
+	}
+	expectBootstrap := func(email string) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO bootstrap(id)")).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM users)")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role)")).WithArgs(email, sqlmock.AnyArg(), "admin").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("user_create", email, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	//an admin from the configuration is created without issuing a token
+	expectPending(true)
+	expectBootstrap("admin@gmail.com")
+	token, err := controller.Bootstrap(context.Background(), "admin@gmail.com", "S3cure3Pa$$", testClient)
+	if err != nil || token != "" || controller.SetupPending() {
+		t.Fatalf("Bootstrap from configuration returned %q, %v \n", token, err)
+	}
+
+	//an unacceptable admin from the configuration is rejected
+	expectPending(true)
+	if _, err := controller.Bootstrap(context.Background(), "admin@gmail.com", "short", testClient); !errors.Is(err, ErrInvalidAdmin) {
+		t.Errorf("Bootstrap with a short password returned %v, want %v", err, ErrInvalidAdmin)
+	}
+
+	//without one, a token is issued and can be redeemed once
+	expectPending(true)
+	token, err = controller.Bootstrap(context.Background(), "", "", testClient)
+	if err != nil || token == "" || !controller.SetupPending() {
+		t.Fatalf("Bootstrap did not issue a setup token: %v \n", err)
+	}
+	if err := controller.CompleteSetup(context.Background(), "wrong", "admin@gmail.com", "S3cure3Pa$$", testClient); err != ErrInvalidSetupToken {
+		t.Errorf("Setup with a wrong token returned %v, want %v", err, ErrInvalidSetupToken)
+	}
+	expectBootstrap("admin@gmail.com")
+	if err := controller.CompleteSetup(context.Background(), token, "admin@gmail.com", "S3cure3Pa$$", testClient); err != nil {
+		t.Fatalf("Setup failed: %v \n", err)
+	}
+	if err := controller.CompleteSetup(context.Background(), token, "admin@gmail.com", "S3cure3Pa$$", testClient); err != ErrInvalidSetupToken {
+		t.Errorf("Setup token was accepted twice: %v", err)
+	}
+
+	//once bootstrapped, no token is issued any more
+	expectPending(false)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}))
+	if token, err := controller.Bootstrap(context.Background(), "", "", testClient); err != nil || token != "" || controller.SetupPending() {
+		t.Errorf("Bootstrap after completion returned %q, %v", token, err)
+	}
+
+	//checking the former default account is not a login, so it never locks the account
+	hash, err := passwords.Bcrypt{Cost: 4}.Hash("changed")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v \n", err)
+	}
+	for i := 0; i < 2; i++ {
+		expectPending(false)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+			WithArgs("e@g.c").
+			WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow(hash, "active", 4, nil))
+		if _, err := controller.Bootstrap(context.Background(), "", "", testClient); err != nil {
+			t.Errorf("Bootstrap after completion failed: %v", err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
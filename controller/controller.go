@@ -1,54 +1,372 @@
 package controller
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"iotdashboard/tracing"
 	"iotdashboard/utils"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("iotdashboard/controller")
+
 type ControllerService struct {
 	PSQL      *dbmanager.DBManager
 	TokenUtil *utils.TokenUtil
+	Logger    *slog.Logger
+	Metrics   *metrics.Metrics
+	// Invites configures how invitations are delivered. Without a Mailer, users cannot be invited.
+	Invites InviteOptions
+	// Registration configures self-registration, which is disabled by default
+	Registration RegistrationOptions
+	// DeletedRetention is how long deleted users are kept before they are purged
+	DeletedRetention time.Duration
+
+	setupMu sync.Mutex
+	// setupTokenHash is the hash of the one-time token redeemable at /setup, empty when there is none
+	setupTokenHash string
+
+	purgeStop chan struct{}
+	purgeDone chan struct{}
 }
 
-func NewController() (*ControllerService, error) {
-	psql, err := dbmanager.New("postgres", "postgres", "iot_dashboard")
+// NewController connects to the database described by dbOpts and loads the JWT signing key
+func NewController(dbOpts dbmanager.Options, logger *slog.Logger, m *metrics.Metrics) (*ControllerService, error) {
+	psql, err := dbmanager.Open(context.Background(), dbOpts, logger.With("component", "dbmanager"))
 	if err != nil {
 		return &ControllerService{}, err
 	}
-	tokenUtil, err := utils.NewTokenUtil()
+	tokenUtil, err := utils.NewTokenUtil(logger.With("component", "tokenutil"))
 	if err != nil {
 		return &ControllerService{}, err
 	}
 
-	return &ControllerService{psql, tokenUtil}, nil
+	m.RegisterDBStats(psql.DB, "iot_dashboard")
+	m.RegisterGaugeFunc("blocklist_size", "Number of JWTs on the logout blocklist.", func() float64 {
+		return float64(tokenUtil.BlocklistSize())
+	})
+
+	psql.HashLimiter = NewHashLimiter(dbOpts.HashConcurrency, dbOpts.HashQueue, m)
+	return &ControllerService{PSQL: psql, TokenUtil: tokenUtil, Logger: logger, Metrics: m, DeletedRetention: DefaultDeletedRetention}, nil
+}
+
+// Close stops the blocklist janitor and the purger and closes the database connections
+func (ct *ControllerService) Close() error {
+	ct.TokenUtil.StopJanitor()
+	ct.StopPurger()
+	return ct.PSQL.DB.Close()
 }
 
-func (ct *ControllerService) Login(email, password string) (string, error) {
+// IsUnavailable reports whether err means the database did not answer in time, the request was cancelled
+// or too many passwords were being checked, rather than that the operation itself failed
+func IsUnavailable(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, ErrBusy)
+}
+
+// ClientInfo describes the client a request originated from, for the audit log
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// Login checks the password of the user identified by login, which is either their email or their username,
+// and returns a JWT for the user
+func (ct *ControllerService) Login(ctx context.Context, login, password string, client ClientInfo) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Login")
+	defer func() { tracing.End(span, err) }()
+
+	// log and audit under the address the user is stored as
+	email := login
+	if !strings.Contains(login, "@") {
+		email, err = ct.PSQL.EmailForUsername(ctx, login)
+		if IsUnavailable(err) {
+			ct.Metrics.Logins.WithLabelValues("error").Inc()
+			ct.Logger.WarnContext(ctx, "Login aborted", "username", login, "error", err)
+			return "", err
+		}
+		if err != nil {
+			// an unknown username fails the password check below like an unknown email does
+			email = login
+		}
+	} else if normalized, err := dbmanager.NormalizeEmail(login); err == nil {
+		email = normalized
+	}
+
 	// validate basic auth
-	err := ct.PSQL.CheckUserCredentials(email, password)
+	start := time.Now()
+	err = ct.PSQL.CheckUserCredentials(ctx, email, password)
+	ct.Metrics.PasswordCheckDuration.Observe(time.Since(start).Seconds())
+	if errors.Is(err, ErrBusy) {
+		ct.Metrics.Logins.WithLabelValues("busy").Inc()
+		ct.Logger.WarnContext(ctx, "Login rejected, too many password checks in progress", "email", email)
+		return "", err
+	}
+	if IsUnavailable(err) {
+		// the database did not answer in time, which says nothing about the credentials
+		ct.Metrics.Logins.WithLabelValues("error").Inc()
+		ct.Logger.WarnContext(ctx, "Login aborted", "email", email, "error", err)
+		return "", err
+	}
+	if err != nil {
+		// the reason is only logged, clients are told the same whatever it is
+		ct.Metrics.Logins.WithLabelValues("failure").Inc()
+		ct.Logger.InfoContext(ctx, "Login failed", "email", email, "error", err)
+		ct.audit(ctx, dbmanager.AuditLoginFailure, email, client, err.Error())
+		if errors.Is(err, dbmanager.ErrBadPassword) && errors.Is(err, dbmanager.ErrLocked) {
+			ct.audit(ctx, dbmanager.AuditLockout, email, client, fmt.Sprintf("after %d failed logins", ct.PSQL.LockoutThreshold))
+		}
+		return "", err
+	}
+	user, err := ct.PSQL.GetUser(ctx, email)
 	if err != nil {
 		return "", err
 	}
 
 	// create and return JWT
-	token, err := ct.TokenUtil.CreateJWT(time.Second * 60)
+	_, signSpan := tracer.Start(ctx, "TokenUtil.CreateJWT")
+	token, err := ct.TokenUtil.CreateJWT(user.Email, user.Role, time.Second*60)
+	tracing.End(signSpan, err)
 	if err != nil {
+		ct.Logger.ErrorContext(ctx, "JWT creation failed", "error", err)
 		return "", err
 	}
+	ct.Metrics.Logins.WithLabelValues("success").Inc()
+	ct.Logger.InfoContext(ctx, "Login succeeded", "email", email)
+	ct.audit(ctx, dbmanager.AuditLoginSuccess, email, client, "")
 	return token, nil
 }
 
-func (ct *ControllerService) Logout(token string) error {
+func (ct *ControllerService) Logout(ctx context.Context, token string, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Logout")
+	defer func() { tracing.End(span, err) }()
+
 	// validate CSRF
 
 	// validate JWT
-	exp, err := ct.TokenUtil.GetJWTExpiry(token)
+	claims, err := ct.Authenticate(ctx, token)
 	if err != nil {
+		ct.Logger.InfoContext(ctx, "Logout rejected", "error", err)
 		return err
 	}
 	// blocklist JWT
-	ct.TokenUtil.BlockListToken(token, exp)
+	ct.TokenUtil.BlockListToken(token, time.Unix(claims.ExpiresAt, 0))
+	ct.audit(ctx, dbmanager.AuditLogout, claims.Subject, client, "")
 	return nil
 
 }
+
+// Authenticate returns the claims of a valid, non-blocklisted JWT of an active subject that was issued after the
+// subject's sessions were last revoked. Tokens of disabled, deleted and purged users are rejected with
+// dbmanager.ErrDisabled. Tokens an OAuth client obtained for itself have no user behind them and are not checked.
+func (ct *ControllerService) Authenticate(ctx context.Context, token string) (_ *utils.Claims, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Authenticate")
+	defer func() { tracing.End(span, err) }()
+
+	_, parseSpan := tracer.Start(ctx, "TokenUtil.ParseJWT")
+	claims, err := ct.TokenUtil.ParseJWT(token)
+	tracing.End(parseSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ClientID != "" && claims.Subject == claims.ClientID {
+		return claims, nil
+	}
+	revoked, active, err := ct.PSQL.SessionState(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, dbmanager.ErrDisabled
+	}
+	// IssuedAt has a resolution of seconds, so a token from the second of the revocation is rejected as well
+	if !revoked.IsZero() && claims.IssuedAt <= revoked.Unix() {
+		return nil, utils.ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// AuthenticateCertificate maps a verified client certificate to its service principal and returns the same claims
+// a JWT session carries. The certificate's URI, DNS and email SANs are tried in that order, then its subject common name.
+func (ct *ControllerService) AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (_ *utils.Claims, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.AuthenticateCertificate")
+	defer func() { tracing.End(span, err) }()
+
+	for _, identity := range certIdentities(cert) {
+		principal, err := ct.PSQL.GetServicePrincipal(ctx, identity)
+		if err == dbmanager.ErrPrincipalNonexistant {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ct.Logger.DebugContext(ctx, "Client certificate authenticated", "principal", principal.Name, "identity", identity)
+		return &utils.Claims{
+			Role: principal.Role,
+			StandardClaims: jwt.StandardClaims{
+				Subject:   principal.Name,
+				IssuedAt:  time.Now().Unix(),
+				NotBefore: cert.NotBefore.Unix(),
+				ExpiresAt: cert.NotAfter.Unix(),
+			},
+		}, nil
+	}
+	ct.Logger.InfoContext(ctx, "Client certificate does not match a service principal", "subject", cert.Subject.String())
+	return nil, dbmanager.ErrPrincipalNonexistant
+}
+
+func certIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// ChangePassword sets a new password for a user after verifying the current one
+func (ct *ControllerService) ChangePassword(ctx context.Context, email, oldPassword, newPassword string, client ClientInfo) error {
+	err := ct.PSQL.CheckUserCredentials(ctx, email, oldPassword)
+	if IsUnavailable(err) {
+		// not a rejection: the current password could not be checked at all
+		ct.Logger.WarnContext(ctx, "Password change aborted", "email", email, "error", err)
+		return err
+	}
+	if err != nil {
+		ct.audit(ctx, dbmanager.AuditPasswordChange, email, client, "rejected: "+err.Error())
+		return err
+	}
+	err = ct.PSQL.SetUserPassword(ctx, email, newPassword)
+	if err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditPasswordChange, email, client, "")
+	return nil
+}
+
+// SetUserRole assigns a role to a user on behalf of actor, who is recorded in the audit log
+func (ct *ControllerService) SetUserRole(ctx context.Context, actor, email, role string, client ClientInfo) error {
+	if role != dbmanager.RoleUser && role != dbmanager.RoleAdmin {
+		return fmt.Errorf("Unknown role %q", role)
+	}
+	err := ct.PSQL.SetUserRole(ctx, email, role)
+	if err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditRoleChange, email, client, fmt.Sprintf("set to %s by %s", role, actor))
+	return nil
+}
+
+// SetUsername sets the username a user can log in with on behalf of actor, or removes it if username is empty
+func (ct *ControllerService) SetUsername(ctx context.Context, actor, email, username string, client ClientInfo) error {
+	if err := ct.PSQL.SetUsername(ctx, email, username); err != nil {
+		return err
+	}
+	reason := "removed by " + actor
+	if username != "" {
+		normalized, _ := dbmanager.NormalizeUsername(username)
+		reason = fmt.Sprintf("set to %s by %s", normalized, actor)
+	}
+	ct.audit(ctx, dbmanager.AuditUsernameChange, email, client, reason)
+	return nil
+}
+
+// AddUser creates a user with the given role on behalf of actor, who is recorded in the audit log
+func (ct *ControllerService) AddUser(ctx context.Context, actor, email, password, role string, client ClientInfo) error {
+	if role != dbmanager.RoleUser && role != dbmanager.RoleAdmin {
+		return fmt.Errorf("Unknown role %q", role)
+	}
+	email, err := dbmanager.NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	if err := ct.PSQL.AddNewUser(ctx, email, password); err != nil {
+		return err
+	}
+	if role != dbmanager.RoleUser {
+		if err := ct.PSQL.SetUserRole(ctx, email, role); err != nil {
+			return err
+		}
+	}
+	ct.audit(ctx, dbmanager.AuditUserCreate, email, client, fmt.Sprintf("as %s by %s", role, actor))
+	return nil
+}
+
+// ResetPassword sets a user's password on behalf of actor without requiring the current one,
+// and revokes the user's sessions
+func (ct *ControllerService) ResetPassword(ctx context.Context, actor, email, password string, client ClientInfo) error {
+	if err := ct.PSQL.SetUserPassword(ctx, email, password); err != nil {
+		return err
+	}
+	if err := ct.PSQL.RevokeSessions(ctx, email); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditPasswordChange, email, client, "reset by "+actor)
+	return nil
+}
+
+// DisableUser stops a user from logging in and revokes their sessions on behalf of actor.
+// Their API keys are suspended rather than revoked and work again once the user is re-enabled.
+func (ct *ControllerService) DisableUser(ctx context.Context, actor, email string, client ClientInfo) error {
+	if err := ct.PSQL.DisableUser(ctx, email); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditUserDisable, email, client, "by "+actor)
+	return nil
+}
+
+// EnableUser lets a disabled or deleted user log in again on behalf of actor
+func (ct *ControllerService) EnableUser(ctx context.Context, actor, email string, client ClientInfo) error {
+	if err := ct.PSQL.EnableUser(ctx, email); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditUserEnable, email, client, "by "+actor)
+	return nil
+}
+
+// DeleteUser soft deletes a user on behalf of actor, revoking their sessions and API keys. The account can be
+// restored with EnableUser until it is purged DeletedRetention later.
+func (ct *ControllerService) DeleteUser(ctx context.Context, actor, email string, client ClientInfo) error {
+	if err := ct.PSQL.DeleteUser(ctx, email); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditUserDelete, email, client, "by "+actor)
+	return nil
+}
+
+// RevokeSessions invalidates every JWT issued to a user so far, on behalf of actor
+func (ct *ControllerService) RevokeSessions(ctx context.Context, actor, email string, client ClientInfo) error {
+	if err := ct.PSQL.RevokeSessions(ctx, email); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditSessionsRevoke, email, client, "by "+actor)
+	return nil
+}
+
+// audit records an event in the audit log. Failures are logged but never block the action being audited.
+// The event is recorded even if the client has gone away in the meantime.
+func (ct *ControllerService) audit(ctx context.Context, eventType, email string, client ClientInfo, reason string) {
+	err := ct.PSQL.RecordAuditEvent(context.WithoutCancel(ctx), dbmanager.AuditEvent{
+		Type:      eventType,
+		Email:     email,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		Reason:    reason,
+	})
+	if err != nil {
+		ct.Logger.ErrorContext(ctx, "Failed to record audit event", "type", eventType, "email", email, "error", err)
+	}
+}
@@ -1,12 +1,27 @@
 package controller
 
 import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"iotdashboard/utils"
+	"log/slog"
+	"net/url"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
+var testLogger = utils.NewLogger(io.Discard, "text", slog.LevelInfo)
+
+var testClient = ClientInfo{IP: "10.0.0.1", UserAgent: "go-test"}
+
 func TestLoginAndLogout(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -14,7 +29,7 @@ func TestLoginAndLogout(t *testing.T) {
 	}
 	defer db.Close()
 
-	controller, err := NewController()
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
 	if err != nil {
 		t.Fatalf("Failed to initialize new controller: %v \n", err)
 	}
@@ -31,28 +46,304 @@ func TestLoginAndLogout(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		rows := sqlmock.NewRows([]string{"password"}).
-			AddRow(c.hashedPassword)
-		mock.ExpectQuery(regexp.QuoteMeta("SELECT password from users WHERE email = $1")).
+		rows := sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).
+			AddRow(c.hashedPassword, "active", 0, nil)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
 			WillReturnRows(rows)
+		if c.success {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+				WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+					AddRow(1, c.email, "", "user", "active", nil, time.Now()))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+				WithArgs("login_success", c.email, testClient.IP, testClient.UserAgent, "").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		} else {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+				WithArgs("login_failure", c.email, testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
 
-		jwt, err := controller.Login(c.email, c.password)
+		jwt, err := controller.Login(context.Background(), c.email, c.password, testClient)
 		if (err != nil && c.success) || (err == nil && !c.success) {
 			t.Errorf("Login failed (email: %s - pass: %s). Error: %v", c.email, c.password, err)
 		}
 
 		// if successful login, test logout
 		if c.success == true {
-			err = controller.Logout(jwt)
+			expectSessionCheck(mock, c.email)
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+				WithArgs("logout", c.email, testClient.IP, testClient.UserAgent, "").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			err = controller.Logout(context.Background(), jwt, testClient)
 			if err != nil {
 				t.Errorf("Logout failed (email: %s - pass: %s). Error: %v", c.email, c.password, err)
 			}
 			//test second logout on same JWT
-			err = controller.Logout(jwt)
+			err = controller.Logout(context.Background(), jwt, testClient)
 			if err == nil {
 				t.Errorf("Logout succeded when it should have failed (email: %s - pass: %s).", c.email, c.password)
 			}
 		}
 	}
 
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestLoginWithUsername(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email from users WHERE username = $1")).
+		WithArgs("tech1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WithArgs("user@gmail.com").
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+			AddRow(1, "user@gmail.com", "tech1", "user", "active", nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("login_success", "user@gmail.com", testClient.IP, testClient.UserAgent, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	jwt, err := controller.Login(context.Background(), "Tech1", "S3cure3Pa$$", testClient)
+	if err != nil {
+		t.Fatalf("Login with a username failed: %v \n", err)
+	}
+	claims, err := controller.TokenUtil.ParseJWT(jwt)
+	if err != nil || claims.Subject != "user@gmail.com" {
+		t.Errorf("Token was issued for %+v, want the user's email: %v", claims, err)
+	}
+
+	//an unknown username fails like a wrong password
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email from users WHERE username = $1")).
+		WithArgs("tech2").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WithArgs("tech2").
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("login_failure", "tech2", testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := controller.Login(context.Background(), "tech2", "S3cure3Pa$$", testClient); err == nil {
+		t.Errorf("Login with an unknown username succeeded")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	//the last allowed wrong password locks the account
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).
+			AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 4, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET")).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_logins"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("login_failure", "user@gmail.com", testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("lockout", "user@gmail.com", testClient.IP, testClient.UserAgent, "after 5 failed logins").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := controller.Login(context.Background(), "user@gmail.com", "wrongpass", testClient); !errors.Is(err, dbmanager.ErrLocked) {
+		t.Errorf("Login that locks the account returned %v, want %v", err, dbmanager.ErrLocked)
+	}
+
+	//a correct password is refused while locked
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).
+			AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, time.Now().UTC().Add(time.Minute)))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("login_failure", "user@gmail.com", testClient.IP, testClient.UserAgent, dbmanager.ErrLocked.Error()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := controller.Login(context.Background(), "user@gmail.com", "S3cure3Pa$$", testClient); err != dbmanager.ErrLocked {
+		t.Errorf("Login to a locked account returned %v, want %v", err, dbmanager.ErrLocked)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET role = $2 WHERE email = $1;")).
+		WithArgs("user@gmail.com", "admin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("role_change", "user@gmail.com", testClient.IP, testClient.UserAgent, "set to admin by root@gmail.com").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := controller.SetUserRole(context.Background(), "root@gmail.com", "user@gmail.com", "admin", testClient); err != nil {
+		t.Errorf("Setting role failed: %v", err)
+	}
+	if err := controller.SetUserRole(context.Background(), "root@gmail.com", "user@gmail.com", "superuser", testClient); err == nil {
+		t.Errorf("Setting an unknown role succeeded when it should have failed")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestAuthenticateRevokedSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	token, err := controller.TokenUtil.CreateJWT("user@gmail.com", "user", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+
+	cases := []struct {
+		revoked interface{}
+		status  string
+		valid   bool
+	}{
+		{nil, "active", true},
+		{time.Now().Add(-time.Hour).UTC(), "active", true},
+		{time.Now().UTC(), "active", false},
+		{time.Now().Add(time.Second).UTC(), "active", false},
+		//disabling or deleting a user also revokes their sessions, but the status is checked regardless
+		{nil, "disabled", false},
+		{nil, "deleted", false},
+	}
+	for _, c := range cases {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).WithArgs("user@gmail.com").
+			WillReturnRows(sqlmock.NewRows([]string{"sessions_revoked_at", "status"}).AddRow(c.revoked, c.status))
+		if _, err := controller.Authenticate(context.Background(), token); (err == nil) != c.valid {
+			t.Errorf("Token of %s user with sessions revoked at %v: got error %v, want valid %v", c.status, c.revoked, err, c.valid)
+		}
+	}
+
+	//a purged user is gone for good, even if their token has not expired yet
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).WithArgs("user@gmail.com").
+		WillReturnRows(sqlmock.NewRows([]string{"sessions_revoked_at", "status"}))
+	if _, err := controller.Authenticate(context.Background(), token); err != dbmanager.ErrDisabled {
+		t.Errorf("Token of a purged user: got error %v, want %v", err, dbmanager.ErrDisabled)
+	}
+	//tokens an OAuth client obtained for itself have no user to check
+	clientToken, err := controller.TokenUtil.CreateScopedJWT("grafana", "user", "", "grafana", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	if _, err := controller.Authenticate(context.Background(), clientToken); err != nil {
+		t.Errorf("Client credentials token rejected: %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = $2, sessions_revoked_at = $3 WHERE email = $1 AND status = $4;")).
+		WithArgs("user@gmail.com", "disabled", sqlmock.AnyArg(), "active").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_disable", "user@gmail.com", testClient.IP, testClient.UserAgent, "by root@gmail.com").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := controller.DisableUser(context.Background(), "root@gmail.com", "user@gmail.com", testClient); err != nil {
+		t.Errorf("Disabling user failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	spiffe, _ := url.Parse("spiffe://iot/gateway-1")
+	cert := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "gateway-1"},
+		URIs:      []*url.URL{spiffe},
+		DNSNames:  []string{"gateway-1.iot.internal"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	query := regexp.QuoteMeta("SELECT id, name, identity, role, created from service_principals WHERE identity = $1")
+	columns := []string{"id", "name", "identity", "role", "created"}
+
+	//the URI SAN is unknown, so the DNS SAN is tried next
+	mock.ExpectQuery(query).WithArgs("spiffe://iot/gateway-1").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(query).WithArgs("gateway-1.iot.internal").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "gateway-1", "gateway-1.iot.internal", "admin", time.Now()))
+
+	claims, err := controller.AuthenticateCertificate(context.Background(), cert)
+	if err != nil {
+		t.Fatalf("Certificate authentication failed: %v \n", err)
+	}
+	if claims.Subject != "gateway-1" || claims.Role != "admin" || claims.ExpiresAt != cert.NotAfter.Unix() {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	for _, identity := range []string{"spiffe://iot/gateway-1", "gateway-1.iot.internal", "gateway-1"} {
+		mock.ExpectQuery(query).WithArgs(identity).WillReturnRows(sqlmock.NewRows(columns))
+	}
+	if _, err := controller.AuthenticateCertificate(context.Background(), cert); err == nil {
+		t.Errorf("Certificate without a service principal was authenticated")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// expectSessionCheck expects Authenticate to look up when the sessions of email were last revoked, which they never
+// were, and whether the user is active, which they are
+func expectSessionCheck(mock sqlmock.Sqlmock, email string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).
+		WithArgs(email).WillReturnRows(sqlmock.NewRows([]string{"sessions_revoked_at", "status"}).AddRow(nil, "active"))
 }
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"iotdashboard/metrics"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned instead of hashing or verifying a password when too many are already waiting to be,
+// so that the client can retry later rather than wait
+var ErrBusy = errors.New("Too many password checks in progress")
+
+// DefaultHashQueuePerSlot is how many operations may wait per hashing slot unless configured otherwise
+const DefaultHashQueuePerSlot = 8
+
+// HashLimiter bounds how many passwords are hashed or verified at once, so that a burst of logins cannot occupy
+// every core and starve other requests. It is used as the dbmanager.HashLimiter, which only holds a slot while
+// hashing, so that a slow database cannot fill the queue. Operations beyond the limit wait for a slot in a queue of bounded length;
+// once it is full they fail right away with ErrBusy.
+type HashLimiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	queued   atomic.Int64
+	metrics  *metrics.Metrics
+}
+
+// NewHashLimiter allows concurrency operations at once and queue more to wait for them. A concurrency of zero or
+// less uses half the CPUs, and a queue of zero or less DefaultHashQueuePerSlot operations per slot.
+func NewHashLimiter(concurrency, queue int, m *metrics.Metrics) *HashLimiter {
+	if concurrency <= 0 {
+		concurrency = max(1, runtime.GOMAXPROCS(0)/2)
+	}
+	if queue <= 0 {
+		queue = DefaultHashQueuePerSlot * concurrency
+	}
+	return &HashLimiter{slots: make(chan struct{}, concurrency), maxQueue: int64(queue), metrics: m}
+}
+
+// Acquire waits for a free slot and returns the function releasing it. It returns ErrBusy if the queue is full,
+// or the context's error if it ends while waiting.
+func (l *HashLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+		l.metrics.PasswordHashWait.Observe(0)
+		return l.release, nil
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.metrics.PasswordHashRejected.Inc()
+		return nil, ErrBusy
+	}
+	l.metrics.PasswordHashQueue.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		l.metrics.PasswordHashQueue.Dec()
+	}()
+
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		l.metrics.PasswordHashWait.Observe(time.Since(start).Seconds())
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *HashLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"context"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitQueued waits until n operations are waiting for a slot of l
+func waitQueued(t *testing.T, l *HashLimiter, n int64) {
+	deadline := time.Now().Add(time.Second)
+	for l.queued.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d operations are queued, want %d \n", l.queued.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHashLimiterConcurrency(t *testing.T) {
+	l := NewHashLimiter(2, 100, metrics.New())
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			defer release()
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() != 2 {
+		t.Errorf("%d operations ran at once, want 2", peak.Load())
+	}
+}
+
+func TestHashLimiterBusy(t *testing.T) {
+	m := metrics.New()
+	l := NewHashLimiter(1, 1, m)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v \n", err)
+	}
+	// the second operation waits for the slot, the third finds the queue full
+	acquired := make(chan error)
+	go func() {
+		release, err := l.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	waitQueued(t, l, 1)
+	if got := testutil.ToFloat64(m.PasswordHashQueue); got != 1 {
+		t.Errorf("Queue length metric is %v, want 1", got)
+	}
+
+	if _, err := l.Acquire(context.Background()); err != ErrBusy {
+		t.Errorf("Acquire with a full queue returned %v, want %v", err, ErrBusy)
+	}
+	if got := testutil.ToFloat64(m.PasswordHashRejected); got != 1 {
+		t.Errorf("Rejected metric is %v, want 1", got)
+	}
+	if !IsUnavailable(ErrBusy) {
+		t.Errorf("ErrBusy is not reported as unavailable")
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("Queued Acquire failed: %v", err)
+	}
+	if got := testutil.ToFloat64(m.PasswordHashQueue); got != 0 {
+		t.Errorf("Queue length metric is %v after the queue drained, want 0", got)
+	}
+	if got := testutil.CollectAndCount(m.PasswordHashWait); got != 1 {
+		t.Errorf("Wait time histogram has %d series, want 1", got)
+	}
+}
+
+func TestHashLimiterCancel(t *testing.T) {
+	l := NewHashLimiter(1, 1, metrics.New())
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v \n", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Acquire after the deadline returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := l.queued.Load(); n != 0 {
+		t.Errorf("%d operations are still queued after giving up", n)
+	}
+}
+
+// TestHashLimiterSlowDatabase checks that a slot is only held while hashing, not while waiting for the database
+func TestHashLimiterSlowDatabase(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+	limiter := NewHashLimiter(1, 1, controller.Metrics)
+	controller.PSQL.HashLimiter = limiter
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillDelayFor(200 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+			AddRow(1, "user@gmail.com", "", "user", "active", nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	done := make(chan error)
+	go func() {
+		_, err := controller.Login(context.Background(), "user@gmail.com", "S3cure3Pa$$", testClient)
+		done <- err
+	}()
+
+	// while the login waits for the database, the only slot is free
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	release, err := limiter.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Slot is held during a database query: %v \n", err)
+	}
+	release()
+
+	if err := <-done; err != nil {
+		t.Errorf("Login failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNewControllerConfiguresHashLimiter(t *testing.T) {
+	opts := dbmanager.DefaultOptions()
+	opts.HashConcurrency, opts.HashQueue = 3, 5
+	controller, err := NewController(opts, testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	l, ok := controller.PSQL.HashLimiter.(*HashLimiter)
+	if !ok || cap(l.slots) != 3 || l.maxQueue != 5 {
+		t.Errorf("Hash limiter %+v does not follow the options", controller.PSQL.HashLimiter)
+	}
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"iotdashboard/tracing"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultInviteTTL is how long an invitation can be accepted when InviteOptions.TTL is not set
+const DefaultInviteTTL = 72 * time.Hour
+
+// ErrInvalidInvitation is returned when an invitation names an unknown role or an invalid email address
+var ErrInvalidInvitation = errors.New("Invalid invitation")
+
+// ErrInvalidPassword is returned when an invitee chooses a password that is too short
+var ErrInvalidPassword = errors.New("Invalid password")
+
+// InviteOptions configures the invitation emails
+type InviteOptions struct {
+	Mailer mailer.Sender
+	// BaseURL is the public address of the dashboard that invitation links point to, e.g. https://dashboard.example.com
+	BaseURL string
+	TTL     time.Duration
+}
+
+// InviteUser invites email to join with the given role on behalf of actor. The invitee is sent a single-use link
+// to choose a password with; the account cannot be used until then. Inviting a pending invitee again sends a new
+// link and invalidates the previous one.
+func (ct *ControllerService) InviteUser(ctx context.Context, actor, email, role string, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.InviteUser")
+	defer func() { tracing.End(span, err) }()
+
+	if role != dbmanager.RoleUser && role != dbmanager.RoleAdmin {
+		return fmt.Errorf("%w: unknown role %q", ErrInvalidInvitation, role)
+	}
+	email, err = dbmanager.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInvitation, err)
+	}
+	if ct.Invites.Mailer == nil {
+		return mailer.ErrDisabled
+	}
+	ttl := ct.Invites.TTL
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+
+	token, err := ct.TokenUtil.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
+	inv := dbmanager.Invitation{Email: email, Role: role, InvitedBy: actor, Expires: time.Now().UTC().Add(ttl)}
+	if err := ct.PSQL.CreateInvitation(ctx, inv, hashToken(token)); err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(ct.Invites.BaseURL, "/") + "/invite?token=" + url.QueryEscape(token)
+	err = ct.Invites.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "You have been invited to the IoT Dashboard",
+		Body: fmt.Sprintf("%s has invited you to the IoT Dashboard.\n\n"+
+			"Choose your password at the following link to activate your account:\n\n%s\n\n"+
+			"The link can be used once and expires on %s. If you did not expect this invitation, you can ignore it.\n",
+			actor, link, inv.Expires.Format(time.RFC1123)),
+	})
+	if err != nil {
+		ct.Logger.ErrorContext(ctx, "Failed to send invitation", "email", email, "error", err)
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditUserInvite, email, client, fmt.Sprintf("as %s by %s", role, actor))
+	return nil
+}
+
+// Invitation returns the pending invitation for token, or dbmanager.ErrInvitationNonexistant
+func (ct *ControllerService) Invitation(ctx context.Context, token string) (dbmanager.Invitation, error) {
+	return ct.PSQL.GetInvitation(ctx, hashToken(token))
+}
+
+// AcceptInvitation activates the invited account with the password chosen by the invitee, which verifies that they
+// own the email address. The token cannot be used again. It returns the email of the activated user.
+func (ct *ControllerService) AcceptInvitation(ctx context.Context, token, password string, client ClientInfo) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.AcceptInvitation")
+	defer func() { tracing.End(span, err) }()
+
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("%w: password must be at least %d characters", ErrInvalidPassword, MinPasswordLength)
+	}
+	email, err := ct.PSQL.AcceptInvitation(ctx, hashToken(token), password)
+	if err != nil {
+		return "", err
+	}
+	ct.audit(ctx, dbmanager.AuditUserVerify, email, client, "invitation accepted")
+	return email, nil
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"iotdashboard/metrics"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInviteAndAccept(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+	dir := t.TempDir()
+	controller.Invites = InviteOptions{
+		Mailer:  &mailer.FileSender{Dir: dir, From: "noreply@example.com"},
+		BaseURL: "https://dashboard.example.com/",
+		TTL:     time.Hour,
+	}
+
+	for _, c := range []struct{ email, role string }{{"user@gmail.com", "root"}, {"Mallory <user@gmail.com>", "user"}, {"nobody", "user"}} {
+		if err := controller.InviteUser(context.Background(), "admin@gmail.com", c.email, c.role, testClient); !errors.Is(err, ErrInvalidInvitation) {
+			t.Errorf("Inviting %q as %q returned %v, want %v", c.email, c.role, err, ErrInvalidInvitation)
+		}
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations WHERE email = $1;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	var storedHash string
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations(email,hash,invited_by,expires)")).
+		WithArgs("user@gmail.com", captureArg{&storedHash}, "admin@gmail.com", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_invite", "user@gmail.com", testClient.IP, testClient.UserAgent, "as user by admin@gmail.com").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := controller.InviteUser(context.Background(), "admin@gmail.com", "user@gmail.com", "user", testClient); err != nil {
+		t.Fatalf("Inviting failed: %v \n", err)
+	}
+
+	//the token only reaches the invitee through the link in the email
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one email, found %v \n", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read email: %v \n", err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("Failed to parse email: %v \n", err)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("Failed to decode email: %v \n", err)
+	}
+	link := regexp.MustCompile(`https://dashboard\.example\.com/invite\?token=\S+`).Find(body)
+	if link == nil {
+		t.Fatalf("No invitation link in:\n%s \n", body)
+	}
+	u, _ := url.Parse(string(link))
+	token := u.Query().Get("token")
+	if hashToken(token) != storedHash {
+		t.Fatalf("The emailed token %q does not match the stored hash \n", token)
+	}
+
+	if _, err := controller.AcceptInvitation(context.Background(), token, "short", testClient); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Accepting with a short password returned %v, want %v", err, ErrInvalidPassword)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM invitations WHERE hash = $1")).WithArgs(storedHash, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $2, status = $3, verified_at = $4")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_verify", "user@gmail.com", testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if email, err := controller.AcceptInvitation(context.Background(), token, "S3cure3Pa$$", testClient); err != nil || email != "user@gmail.com" {
+		t.Errorf("Accepting invitation returned %q, %v", email, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	controller.Invites.Mailer = nil
+	if err := controller.InviteUser(context.Background(), "admin@gmail.com", "user@gmail.com", "user", testClient); err != mailer.ErrDisabled {
+		t.Errorf("Inviting without a mailer returned %v, want %v", err, mailer.ErrDisabled)
+	}
+}
+
+// captureArg matches any string argument and stores it
+type captureArg struct{ value *string }
+
+func (c captureArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.value = s
+	return ok
+}
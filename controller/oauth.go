@@ -0,0 +1,336 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"iotdashboard/tracing"
+	"iotdashboard/utils"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthorizationCodeLifetime is how long a client has to redeem an authorization code
+	AuthorizationCodeLifetime = time.Minute
+	// OAuthTokenLifetime is how long access tokens issued to OAuth clients are valid
+	OAuthTokenLifetime = 15 * time.Minute
+)
+
+// ErrInvalidRedirect is returned for authorization requests naming an unknown client or an unregistered redirect URI.
+// Unlike other authorization errors it must not be reported by redirecting back to the client.
+var ErrInvalidRedirect = errors.New("Unknown client or redirect URI")
+
+// OAuthError is an error response as defined in RFC 6749 section 5.2
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// AuthorizationRequest holds the parameters of an authorization code request, as sent to the authorization endpoint
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// TokenResponse is a successful token endpoint response as defined in RFC 6749 section 5.1
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// IntrospectionResponse describes a token as defined in RFC 7662 section 2.2. Inactive tokens only report active=false.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Role      string `json:"role,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	// SessionID is the token's jti, shared by every request made with the same login, API key or grant
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// RegisterOAuthClient registers a third-party integration on behalf of actor. Confidential clients receive a secret,
+// which is returned once and not stored. Public clients must use the authorization code grant with PKCE.
+func (ct *ControllerService) RegisterOAuthClient(ctx context.Context, actor string, c dbmanager.OAuthClient, client ClientInfo) (_ string, _ dbmanager.OAuthClient, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.RegisterOAuthClient")
+	defer func() { tracing.End(span, err) }()
+
+	if c.Name == "" || len(c.Name) > 128 {
+		return "", c, errors.New("Client name must be between 1 and 128 characters")
+	}
+	if !c.Confidential && len(c.RedirectURIs) == 0 {
+		return "", c, errors.New("Public clients need at least one redirect URI")
+	}
+	for _, uri := range c.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return "", c, err
+		}
+	}
+	if len(c.Scopes) == 0 {
+		return "", c, errors.New("Client needs at least one scope")
+	}
+	for _, scope := range c.Scopes {
+		if !slices.Contains(dbmanager.Scopes, scope) {
+			return "", c, fmt.Errorf("Unknown scope %q", scope)
+		}
+	}
+	if c.Role == "" {
+		c.Role = dbmanager.RoleUser
+	}
+	if c.Role != dbmanager.RoleUser && c.Role != dbmanager.RoleAdmin {
+		return "", c, fmt.Errorf("Unknown role %q", c.Role)
+	}
+
+	if c.ClientID, err = ct.TokenUtil.GenerateRandomString(24); err != nil {
+		return "", c, err
+	}
+	var secret, secretHash string
+	if c.Confidential {
+		if secret, err = ct.TokenUtil.GenerateRandomString(43); err != nil {
+			return "", c, err
+		}
+		secretHash = hashToken(secret)
+	}
+	c.Created = time.Now().UTC()
+	if err = ct.PSQL.AddOAuthClient(ctx, c, secretHash); err != nil {
+		return "", c, err
+	}
+	ct.audit(ctx, dbmanager.AuditOAuthClient, actor, client, fmt.Sprintf("%s (%s)", c.Name, c.ClientID))
+	return secret, c, nil
+}
+
+// validateRedirectURI only accepts absolute https URIs, or http on the loopback interface for native apps (RFC 8252)
+func validateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return fmt.Errorf("Invalid redirect URI %q", raw)
+	}
+	host := u.Hostname()
+	loopback := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && loopback) {
+		return fmt.Errorf("Redirect URI %q must use https", raw)
+	}
+	return nil
+}
+
+// ListOAuthClients returns every registered client without secrets
+func (ct *ControllerService) ListOAuthClients(ctx context.Context) ([]dbmanager.OAuthClient, error) {
+	return ct.PSQL.ListOAuthClients(ctx)
+}
+
+// ValidateAuthorizationRequest checks an authorization request and returns its client and the scopes it asks for.
+// A missing redirect URI is filled in when the client has registered exactly one.
+// ErrInvalidRedirect must be shown to the user; any other error can be sent back to the redirect URI.
+func (ct *ControllerService) ValidateAuthorizationRequest(ctx context.Context, req *AuthorizationRequest) (dbmanager.OAuthClient, []string, error) {
+	client, _, err := ct.PSQL.GetOAuthClient(ctx, req.ClientID)
+	if err == dbmanager.ErrOAuthClientNonexistant {
+		return client, nil, ErrInvalidRedirect
+	}
+	if err != nil {
+		return client, nil, err
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	// Redirect URIs are compared exactly, as recommended by RFC 9700
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return client, nil, ErrInvalidRedirect
+	}
+
+	if req.ResponseType != "code" {
+		return client, nil, &OAuthError{"unsupported_response_type", "Only the authorization code flow is supported"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return client, nil, &OAuthError{"invalid_request", "PKCE with code_challenge_method S256 is required"}
+	}
+	scopes, err := grantedScopes(req.Scope, client.Scopes)
+	if err != nil {
+		return client, nil, err
+	}
+	return client, scopes, nil
+}
+
+// grantedScopes returns the requested scopes if the client may request them, or all of the client's scopes if none were requested
+func grantedScopes(requested string, allowed []string) ([]string, error) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return allowed, nil
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return nil, &OAuthError{"invalid_scope", fmt.Sprintf("Scope %q is not allowed for this client", scope)}
+		}
+	}
+	return scopes, nil
+}
+
+// Authorize issues an authorization code after the user identified by email consented to a validated request
+func (ct *ControllerService) Authorize(ctx context.Context, email string, req AuthorizationRequest, scopes []string, client ClientInfo) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Authorize")
+	defer func() { tracing.End(span, err) }()
+
+	code, err := ct.TokenUtil.GenerateRandomString(43)
+	if err != nil {
+		return "", err
+	}
+	err = ct.PSQL.AddAuthorizationCode(ctx, dbmanager.AuthorizationCode{
+		ClientID:      req.ClientID,
+		Email:         email,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+		Expires:       time.Now().Add(AuthorizationCodeLifetime).UTC(),
+	}, hashToken(code))
+	if err != nil {
+		return "", err
+	}
+	ct.audit(ctx, dbmanager.AuditOAuthConsent, email, client, fmt.Sprintf("granted %s to %s", strings.Join(scopes, " "), req.ClientID))
+	return code, nil
+}
+
+// DenyAuthorization records that a user declined an authorization request
+func (ct *ControllerService) DenyAuthorization(ctx context.Context, email string, req AuthorizationRequest, client ClientInfo) {
+	ct.audit(ctx, dbmanager.AuditOAuthConsent, email, client, "denied "+req.ClientID)
+}
+
+// AuthenticateOAuthClient verifies a client's credentials. Public clients are identified by their ID alone.
+func (ct *ControllerService) AuthenticateOAuthClient(ctx context.Context, clientID, secret string) (dbmanager.OAuthClient, error) {
+	client, secretHash, err := ct.PSQL.GetOAuthClient(ctx, clientID)
+	if err == dbmanager.ErrOAuthClientNonexistant {
+		return client, &OAuthError{"invalid_client", "Client authentication failed"}
+	}
+	if err != nil {
+		return client, err
+	}
+	if client.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(secretHash)) != 1 {
+		return client, &OAuthError{"invalid_client", "Client authentication failed"}
+	}
+	if !client.Confidential && secret != "" {
+		return client, &OAuthError{"invalid_client", "Public clients have no secret"}
+	}
+	return client, nil
+}
+
+// ExchangeAuthorizationCode redeems an authorization code for an access token on behalf of the user who granted it
+func (ct *ControllerService) ExchangeAuthorizationCode(ctx context.Context, client dbmanager.OAuthClient, code, redirectURI, verifier string) (_ TokenResponse, err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.ExchangeAuthorizationCode")
+	defer func() { tracing.End(span, err) }()
+
+	grant, err := ct.PSQL.ConsumeAuthorizationCode(ctx, hashToken(code))
+	if err == dbmanager.ErrAuthorizationCodeNonexistant {
+		return TokenResponse{}, &OAuthError{"invalid_grant", "Unknown or already redeemed authorization code"}
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if grant.ClientID != client.ClientID || grant.RedirectURI != redirectURI || grant.Expires.Before(time.Now()) {
+		return TokenResponse{}, &OAuthError{"invalid_grant", "Authorization code is invalid"}
+	}
+	if !verifyPKCE(verifier, grant.CodeChallenge) {
+		return TokenResponse{}, &OAuthError{"invalid_grant", "PKCE verification failed"}
+	}
+
+	user, err := ct.PSQL.GetUser(ctx, grant.Email)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return ct.issueToken(user.Email, user.Role, grant.Scopes, client.ClientID)
+}
+
+// verifyPKCE checks a code verifier against an S256 code challenge as defined in RFC 7636 section 4.6
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// ClientCredentialsToken issues a token to a confidential client acting on its own behalf, with the client's role
+func (ct *ControllerService) ClientCredentialsToken(ctx context.Context, client dbmanager.OAuthClient, scope string) (TokenResponse, error) {
+	if !client.Confidential {
+		return TokenResponse{}, &OAuthError{"unauthorized_client", "Public clients cannot use the client credentials grant"}
+	}
+	scopes, err := grantedScopes(scope, client.Scopes)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return ct.issueToken(client.ClientID, client.Role, scopes, client.ClientID)
+}
+
+func (ct *ControllerService) issueToken(subject, role string, scopes []string, clientID string) (TokenResponse, error) {
+	scope := strings.Join(scopes, " ")
+	token, err := ct.TokenUtil.CreateScopedJWT(subject, role, scope, clientID, OAuthTokenLifetime)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(OAuthTokenLifetime.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// IntrospectToken describes a JWT or API key issued by this server.
+// An error is only returned if the token could not be checked, see IsUnavailable.
+func (ct *ControllerService) IntrospectToken(ctx context.Context, token string) (IntrospectionResponse, error) {
+	var claims *utils.Claims
+	var err error
+	tokenType := "Bearer"
+	if IsAPIKey(token) {
+		claims, err = ct.AuthenticateAPIKey(ctx, token)
+		tokenType = "api_key"
+	} else {
+		claims, err = ct.Authenticate(ctx, token)
+	}
+	if IsUnavailable(err) {
+		return IntrospectionResponse{}, err
+	}
+	if err != nil {
+		return IntrospectionResponse{Active: false}, nil
+	}
+	return IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Subject:   claims.Subject,
+		Role:      claims.Role,
+		TokenType: tokenType,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		SessionID: claims.Id,
+	}, nil
+}
+
+// RevokeToken revokes an access token issued to client, as defined in RFC 7009.
+// Tokens that are invalid or belong to another client are ignored, as the RFC requires the same response either way.
+func (ct *ControllerService) RevokeToken(ctx context.Context, client dbmanager.OAuthClient, token string) {
+	claims, err := ct.TokenUtil.ParseJWT(token)
+	if err != nil || claims.ClientID != client.ClientID {
+		return
+	}
+	ct.TokenUtil.BlockListToken(token, time.Unix(claims.ExpiresAt, 0))
+	ct.Logger.InfoContext(ctx, "OAuth token revoked", "client_id", client.ClientID, "subject", claims.Subject)
+}
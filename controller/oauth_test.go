@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func testChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+var clientColumns = []string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}
+
+func TestValidateAuthorizationRequest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	valid := AuthorizationRequest{
+		ResponseType:        "code",
+		ClientID:            "grafana",
+		Scope:               "audit:read",
+		CodeChallenge:       testChallenge(testVerifier),
+		CodeChallengeMethod: "S256",
+	}
+	cases := []struct {
+		modify func(*AuthorizationRequest)
+		code   string
+	}{
+		{func(r *AuthorizationRequest) {}, ""},
+		{func(r *AuthorizationRequest) { r.ClientID = "unknown" }, "redirect"},
+		{func(r *AuthorizationRequest) { r.RedirectURI = "https://attacker.example.org/cb" }, "redirect"},
+		{func(r *AuthorizationRequest) { r.ResponseType = "token" }, "unsupported_response_type"},
+		{func(r *AuthorizationRequest) { r.CodeChallengeMethod = "plain" }, "invalid_request"},
+		{func(r *AuthorizationRequest) { r.CodeChallenge = "" }, "invalid_request"},
+		{func(r *AuthorizationRequest) { r.Scope = "keys:write" }, "invalid_scope"},
+	}
+
+	for _, c := range cases {
+		req := valid
+		c.modify(&req)
+		rows := sqlmock.NewRows(clientColumns)
+		if req.ClientID == "grafana" {
+			rows.AddRow(1, "grafana", "Grafana", nil, "https://grafana.example.com/cb", "audit:read keys:read", "user", time.Now())
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).WithArgs(req.ClientID).WillReturnRows(rows)
+
+		_, scopes, err := controller.ValidateAuthorizationRequest(context.Background(), &req)
+		switch {
+		case c.code == "" && err != nil:
+			t.Errorf("Valid request %+v was rejected: %v", req, err)
+		case c.code == "":
+			if req.RedirectURI != "https://grafana.example.com/cb" || len(scopes) != 1 {
+				t.Errorf("Unexpected redirect URI %s or scopes %v", req.RedirectURI, scopes)
+			}
+		case c.code == "redirect" && err != ErrInvalidRedirect:
+			t.Errorf("Request %+v should not redirect, got: %v", req, err)
+		case c.code != "redirect":
+			if oauthErr, ok := err.(*OAuthError); !ok || oauthErr.Code != c.code {
+				t.Errorf("Request %+v returned %v, want %s", req, err, c.code)
+			}
+		}
+	}
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	client := dbmanager.OAuthClient{ClientID: "grafana", RedirectURIs: []string{"https://grafana.example.com/cb"}}
+	req := AuthorizationRequest{ClientID: "grafana", RedirectURI: "https://grafana.example.com/cb", CodeChallenge: testChallenge(testVerifier)}
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM oauth_codes WHERE expires")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_codes")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("oauth_consent", "user@gmail.com", testClient.IP, testClient.UserAgent, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	code, err := controller.Authorize(context.Background(), "user@gmail.com", req, []string{"audit:read"}, testClient)
+	if err != nil {
+		t.Fatalf("Issuing authorization code failed: %v \n", err)
+	}
+
+	consume := regexp.QuoteMeta("DELETE FROM oauth_codes WHERE hash = $1")
+	grantRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"client_id", "email", "redirect_uri", "scopes", "code_challenge", "expires"}).
+			AddRow("grafana", "user@gmail.com", req.RedirectURI, "audit:read", req.CodeChallenge, time.Now().Add(time.Minute))
+	}
+
+	//a wrong verifier fails and burns the code
+	mock.ExpectQuery(consume).WithArgs(hashToken(code)).WillReturnRows(grantRow())
+	if _, err := controller.ExchangeAuthorizationCode(context.Background(), client, code, req.RedirectURI, strings.Repeat("x", 43)); err == nil {
+		t.Errorf("Code was exchanged with a wrong PKCE verifier")
+	}
+
+	mock.ExpectQuery(consume).WithArgs(hashToken(code)).WillReturnRows(grantRow())
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).AddRow(1, "user@gmail.com", "", "admin", "active", nil, time.Now()))
+	token, err := controller.ExchangeAuthorizationCode(context.Background(), client, code, req.RedirectURI, testVerifier)
+	if err != nil {
+		t.Fatalf("Exchanging authorization code failed: %v \n", err)
+	}
+	expectSessionCheck(mock, "user@gmail.com")
+	claims, err := controller.Authenticate(context.Background(), token.AccessToken)
+	if err != nil || claims.Subject != "user@gmail.com" || claims.Role != "admin" || claims.Scope != "audit:read" || claims.ClientID != "grafana" {
+		t.Errorf("Unexpected access token claims %+v: %v", claims, err)
+	}
+
+	//a redeemed code is gone
+	mock.ExpectQuery(consume).WithArgs(hashToken(code)).WillReturnRows(sqlmock.NewRows([]string{"client_id"}))
+	if _, err := controller.ExchangeAuthorizationCode(context.Background(), client, code, req.RedirectURI, testVerifier); err == nil {
+		t.Errorf("Authorization code was redeemed twice")
+	}
+
+	//tokens can only be revoked by the client they were issued to
+	controller.RevokeToken(context.Background(), dbmanager.OAuthClient{ClientID: "other"}, token.AccessToken)
+	expectSessionCheck(mock, "user@gmail.com")
+	if introspection, _ := controller.IntrospectToken(context.Background(), token.AccessToken); !introspection.Active {
+		t.Errorf("Token was revoked by another client")
+	}
+	controller.RevokeToken(context.Background(), client, token.AccessToken)
+	if introspection, _ := controller.IntrospectToken(context.Background(), token.AccessToken); introspection.Active {
+		t.Errorf("Revoked token is still active: %+v", introspection)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	query := regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")
+	mock.ExpectQuery(query).WithArgs("exporter").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow(2, "exporter", "Exporter", hashToken("s3cret"), "", "audit:read", "admin", time.Now()))
+	if _, err := controller.AuthenticateOAuthClient(context.Background(), "exporter", "wrong"); err == nil {
+		t.Errorf("Client authenticated with a wrong secret")
+	}
+
+	mock.ExpectQuery(query).WithArgs("exporter").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow(2, "exporter", "Exporter", hashToken("s3cret"), "", "audit:read", "admin", time.Now()))
+	client, err := controller.AuthenticateOAuthClient(context.Background(), "exporter", "s3cret")
+	if err != nil {
+		t.Fatalf("Client authentication failed: %v \n", err)
+	}
+	if _, err := controller.ClientCredentialsToken(context.Background(), client, "keys:write"); err == nil {
+		t.Errorf("Client obtained a scope it was not registered for")
+	}
+	token, err := controller.ClientCredentialsToken(context.Background(), client, "")
+	if err != nil {
+		t.Fatalf("Client credentials grant failed: %v \n", err)
+	}
+	expectSessionCheck(mock, "exporter")
+	introspection, err := controller.IntrospectToken(context.Background(), token.AccessToken)
+	if err != nil || !introspection.Active || introspection.Subject != "exporter" || introspection.Role != "admin" || introspection.Scope != "audit:read" {
+		t.Errorf("Unexpected introspection: %+v", introspection)
+	}
+
+	public := dbmanager.OAuthClient{ClientID: "spa"}
+	if _, err := controller.ClientCredentialsToken(context.Background(), public, ""); err == nil {
+		t.Errorf("Public client used the client credentials grant")
+	}
+}
+
+func TestRegisterOAuthClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	cases := []struct {
+		client dbmanager.OAuthClient
+		valid  bool
+	}{
+		{dbmanager.OAuthClient{Name: "Grafana", RedirectURIs: []string{"https://grafana.example.com/cb"}, Scopes: []string{"audit:read"}, Confidential: true}, true},
+		{dbmanager.OAuthClient{Name: "CLI", RedirectURIs: []string{"http://127.0.0.1:8400/cb"}, Scopes: []string{"keys:read"}}, true},
+		{dbmanager.OAuthClient{Name: "CLI", Scopes: []string{"keys:read"}}, false},
+		{dbmanager.OAuthClient{Name: "Plain", RedirectURIs: []string{"http://grafana.example.com/cb"}, Scopes: []string{"keys:read"}}, false},
+		{dbmanager.OAuthClient{Name: "Frag", RedirectURIs: []string{"https://grafana.example.com/cb#x"}, Scopes: []string{"keys:read"}}, false},
+		{dbmanager.OAuthClient{Name: "Scopes", RedirectURIs: []string{"https://grafana.example.com/cb"}, Scopes: []string{"root"}}, false},
+		{dbmanager.OAuthClient{Name: "Role", Scopes: []string{"audit:read"}, Confidential: true, Role: "owner"}, false},
+	}
+	for _, c := range cases {
+		if c.valid {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_clients")).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		secret, registered, err := controller.RegisterOAuthClient(context.Background(), "admin@gmail.com", c.client, testClient)
+		if (err == nil) != c.valid {
+			t.Errorf("Registering %+v returned %v, want valid: %v", c.client, err, c.valid)
+			continue
+		}
+		if c.valid && (registered.ClientID == "" || (secret != "") != c.client.Confidential || registered.Role != "user") {
+			t.Errorf("Unexpected registration %+v with secret %q", registered, secret)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"iotdashboard/tracing"
+	"slices"
+	"strings"
+)
+
+// Registration modes. With RegistrationOpen, users who register are emailed an invitation link right away;
+// with RegistrationApproval, an admin has to approve them first.
+const (
+	RegistrationDisabled = "disabled"
+	RegistrationOpen     = "open"
+	RegistrationApproval = "approval"
+)
+
+// registrationActor is recorded in the audit log as the inviter of users who registered themselves
+const registrationActor = "self-registration"
+
+// ErrRegistrationDisabled is returned when self-registration is switched off
+var ErrRegistrationDisabled = errors.New("Registration is disabled")
+
+// ErrDomainNotAllowed is returned when someone registers with an email address outside the allowed domains
+var ErrDomainNotAllowed = errors.New("Registration is not open to this email domain")
+
+// RegistrationOptions configures self-registration
+type RegistrationOptions struct {
+	// Mode is RegistrationDisabled, RegistrationOpen or RegistrationApproval
+	Mode string
+	// Domains lists the email domains that may register, in lower case. Empty allows every domain.
+	Domains []string
+}
+
+// Register signs up email. Depending on the mode, an invitation to choose a password is sent right away or the
+// registration is queued for an admin's approval. Registering an existing user succeeds without doing anything,
+// so that the response does not reveal which addresses have accounts.
+func (ct *ControllerService) Register(ctx context.Context, email string, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.Register")
+	defer func() { tracing.End(span, err) }()
+
+	mode := ct.Registration.Mode
+	if mode != RegistrationOpen && mode != RegistrationApproval {
+		return ErrRegistrationDisabled
+	}
+	email, err = dbmanager.NormalizeEmail(email)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInvitation, err)
+	}
+	if !ct.domainAllowed(email) {
+		ct.Logger.InfoContext(ctx, "Registration from a domain that is not allowed", "email", email, "ip", client.IP)
+		return ErrDomainNotAllowed
+	}
+
+	if mode == RegistrationOpen {
+		err = ct.InviteUser(ctx, registrationActor, email, dbmanager.RoleUser, client)
+		if err == dbmanager.ErrUserExists {
+			ct.Logger.InfoContext(ctx, "Registration for an existing user ignored", "email", email)
+			return nil
+		}
+		return err
+	}
+
+	if _, err := ct.PSQL.GetUser(ctx, email); err != dbmanager.ErrUserNonexistant {
+		if err == nil {
+			ct.Logger.InfoContext(ctx, "Registration for an existing user ignored", "email", email)
+		}
+		return err
+	}
+	err = ct.PSQL.AddRegistration(ctx, dbmanager.Registration{Email: email, IP: client.IP, UserAgent: client.UserAgent})
+	if err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditRegister, email, client, "awaiting approval")
+	return nil
+}
+
+func (ct *ControllerService) domainAllowed(email string) bool {
+	if len(ct.Registration.Domains) == 0 {
+		return true
+	}
+	// email is normalized, so its domain is in the same lower case ASCII form as the allowlist
+	domain := email[strings.LastIndex(email, "@")+1:]
+	return slices.Contains(ct.Registration.Domains, domain)
+}
+
+// ApproveRegistration invites the user of a queued registration on behalf of actor and removes it from the queue.
+// If the email has become a user in the meantime, the registration is removed, which is audited as a rejection,
+// and dbmanager.ErrUserExists returned.
+func (ct *ControllerService) ApproveRegistration(ctx context.Context, actor string, id int, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.ApproveRegistration")
+	defer func() { tracing.End(span, err) }()
+
+	reg, err := ct.PSQL.GetRegistration(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = ct.InviteUser(ctx, actor, reg.Email, dbmanager.RoleUser, client)
+	if err != nil && err != dbmanager.ErrUserExists {
+		return err
+	}
+	if err := ct.PSQL.DeleteRegistration(ctx, id); err != nil {
+		return err
+	}
+	if err == dbmanager.ErrUserExists {
+		ct.audit(ctx, dbmanager.AuditRegisterReject, reg.Email, client, "already a user")
+	}
+	return err
+}
+
+// RejectRegistration removes a queued registration on behalf of actor
+func (ct *ControllerService) RejectRegistration(ctx context.Context, actor string, id int, client ClientInfo) (err error) {
+	ctx, span := tracer.Start(ctx, "ControllerService.RejectRegistration")
+	defer func() { tracing.End(span, err) }()
+
+	reg, err := ct.PSQL.GetRegistration(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := ct.PSQL.DeleteRegistration(ctx, id); err != nil {
+		return err
+	}
+	ct.audit(ctx, dbmanager.AuditRegisterReject, reg.Email, client, "by "+actor)
+	return nil
+}
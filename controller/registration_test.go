@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"iotdashboard/metrics"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRegisterExistingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+	controller.Invites.Mailer = &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}
+
+	if err := controller.Register(context.Background(), "user@gmail.com", testClient); err != ErrRegistrationDisabled {
+		t.Errorf("Registration returned %v while disabled, want %v", err, ErrRegistrationDisabled)
+	}
+
+	//existing users are neither invited nor queued, without telling the caller
+	controller.Registration.Mode = RegistrationOpen
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := controller.Register(context.Background(), "user@gmail.com", testClient); err != nil {
+		t.Errorf("Registering an existing user returned %v", err)
+	}
+
+	controller.Registration.Mode = RegistrationApproval
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+			AddRow(1, "user@gmail.com", "", "user", "active", nil, time.Now()))
+	if err := controller.Register(context.Background(), "user@gmail.com", testClient); err != nil {
+		t.Errorf("Registering an existing user returned %v", err)
+	}
+
+	controller.Registration.Domains = []string{"example.com"}
+	if err := controller.Register(context.Background(), "user@GMAIL.com", testClient); err != ErrDomainNotAllowed {
+		t.Errorf("Registering from another domain returned %v, want %v", err, ErrDomainNotAllowed)
+	}
+	//the allowlist is compared with the normalized domain
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+			AddRow(2, "user@example.com", "", "user", "active", nil, time.Now()))
+	if err := controller.Register(context.Background(), " User@EXAMPLE.com", testClient); err != nil {
+		t.Errorf("Registering from an allowed domain in upper case returned %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestApproveRegistrationOfExistingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+	controller.Invites.Mailer = &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, email, ip, user_agent, created FROM registrations WHERE id = $1")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "ip", "user_agent", "created"}).AddRow(7, "user@gmail.com", "", "", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM registrations WHERE id = $1;")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	//the registration does not vanish from the queue without a trace
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("register_reject", "user@gmail.com", testClient.IP, testClient.UserAgent, "already a user").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := controller.ApproveRegistration(context.Background(), "admin@gmail.com", 7, testClient); err != dbmanager.ErrUserExists {
+		t.Errorf("Approving the registration of an existing user returned %v, want %v", err, dbmanager.ErrUserExists)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"iotdashboard/dbmanager"
+	"time"
+)
+
+// DefaultDeletedRetention is how long deleted users are kept, and can be restored, before they are purged
+const DefaultDeletedRetention = 30 * 24 * time.Hour
+
+// PurgeDeletedUsers permanently removes the users deleted more than DeletedRetention ago and returns how many there were
+func (ct *ControllerService) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	emails, err := ct.PSQL.PurgeDeletedUsers(ctx, time.Now().Add(-ct.DeletedRetention))
+	if err != nil {
+		return 0, err
+	}
+	for _, email := range emails {
+		ct.Logger.InfoContext(ctx, "Purged deleted user", "email", email)
+		ct.audit(ctx, dbmanager.AuditUserPurge, email, ClientInfo{}, fmt.Sprintf("deleted more than %s ago", ct.DeletedRetention))
+	}
+	return len(emails), nil
+}
+
+// StartPurger purges deleted users every interval until StopPurger is called.
+// A non-positive interval disables the purger.
+func (ct *ControllerService) StartPurger(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ct.purgeStop = make(chan struct{})
+	ct.purgeDone = make(chan struct{})
+	go func() {
+		defer close(ct.purgeDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := ct.PurgeDeletedUsers(context.Background()); err != nil {
+					ct.Logger.Error("Failed to purge deleted users", "error", err)
+				}
+			case <-ct.purgeStop:
+				return
+			}
+		}
+	}()
+}
+
+// StopPurger stops the purger started by StartPurger and waits for it to exit. It is a no-op if none is running.
+func (ct *ControllerService) StopPurger() {
+	if ct.purgeStop == nil {
+		return
+	}
+	close(ct.purgeStop)
+	<-ct.purgeDone
+	ct.purgeStop = nil
+}
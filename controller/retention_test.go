@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+	controller.DeletedRetention = 24 * time.Hour
+
+	var before time.Time
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM users WHERE status = $1 AND deleted_at < $2 RETURNING email")).
+		WithArgs(dbmanager.StatusDeleted, captureTime{&before}).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("old@gmail.com"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("user_purge", "old@gmail.com", "", "", "deleted more than 24h0m0s ago").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	n, err := controller.PurgeDeletedUsers(context.Background())
+	if err != nil || n != 1 {
+		t.Errorf("Purging deleted users returned %d, %v", n, err)
+	}
+	if age := time.Since(before); age < 24*time.Hour || age > 25*time.Hour {
+		t.Errorf("Purged users deleted before %v, %v ago", before, age)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestPurger(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	controller, err := NewController(dbmanager.DefaultOptions(), testLogger, metrics.New())
+	if err != nil {
+		t.Fatalf("Failed to initialize new controller: %v \n", err)
+	}
+	//overwrite db connection with mock
+	controller.PSQL.DB = db
+
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM users WHERE status = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}))
+
+	controller.StartPurger(5 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Purger did not run \n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//stopping twice is harmless
+	controller.StopPurger()
+	controller.StopPurger()
+}
+
+// captureTime matches any time argument and stores it
+type captureTime struct{ value *time.Time }
+
+func (c captureTime) Match(v driver.Value) bool {
+	tm, ok := v.(time.Time)
+	*c.value = tm
+	return ok
+}
@@ -0,0 +1,165 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be limited to
+const (
+	ScopeAuditRead = "audit:read"
+	ScopeKeysRead  = "keys:read"
+	ScopeKeysWrite = "keys:write"
+	// ScopeIntrospect lets downstream services validate tokens presented to them
+	ScopeIntrospect = "tokens:introspect"
+	// ScopeAdmin lets an admin's keys and tokens manage invitations, registrations and OAuth clients
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every scope that can be granted
+var Scopes = []string{ScopeAuditRead, ScopeKeysRead, ScopeKeysWrite, ScopeIntrospect, ScopeAdmin}
+
+// ScopeDescriptions explain each scope to users, e.g. on the OAuth consent screen
+var ScopeDescriptions = map[string]string{
+	ScopeAuditRead:  "Read the audit log",
+	ScopeKeysRead:   "List your API keys",
+	ScopeKeysWrite:  "Create and revoke your API keys",
+	ScopeIntrospect: "Validate tokens presented to your service",
+	ScopeAdmin:      "Manage invitations, registrations and OAuth clients, if you are an admin",
+}
+
+var ErrAPIKeyNonexistant = errors.New("API key does not exist")
+
+// APIKey is a personal access token. Only the SHA-256 hash of the secret is stored; Prefix identifies the key in listings.
+type APIKey struct {
+	ID       int        `json:"id"`
+	Email    string     `json:"-"`
+	Role     string     `json:"-"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Scopes   []string   `json:"scopes"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Created  time.Time  `json:"created"`
+}
+
+const apiKeyColumns = `k.id, k.email, u.role, k.name, k.prefix, k.scopes, k.expires, k.last_used, k.created`
+
+//AddAPIKey stores a new key for key.Email and returns its ID
+func (db *DBManager) AddAPIKey(ctx context.Context, key APIKey, hash string) (_ int, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.AddAPIKey", "INSERT")
+	defer end(&err)
+
+	var id int
+	err = db.DB.QueryRowContext(ctx,
+		`INSERT INTO api_keys(email,name,prefix,hash,scopes,expires) VALUES ($1 , $2 , $3 , $4 , $5 , $6) RETURNING id;`,
+		lookupEmail(key.Email), key.Name, key.Prefix, hash, strings.Join(key.Scopes, " "), key.Expires,
+	).Scan(&id)
+	return id, err
+}
+
+//GetAPIKeyByHash returns the unrevoked key with the given hash along with its owner's current role
+func (db *DBManager) GetAPIKeyByHash(ctx context.Context, hash string) (_ APIKey, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetAPIKeyByHash", "SELECT")
+	defer end(&err)
+
+	row := db.DB.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys k JOIN users u ON u.email = k.email
+		WHERE k.hash = $1 AND k.revoked_at IS NULL AND u.status = 'active'`, hash)
+	key, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrAPIKeyNonexistant
+	}
+	return key, err
+}
+
+//ListAPIKeys returns the unrevoked keys of a user, newest first
+func (db *DBManager) ListAPIKeys(ctx context.Context, email string) (_ []APIKey, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.ListAPIKeys", "SELECT")
+	defer end(&err)
+
+	rows, err := db.DB.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys k JOIN users u ON u.email = k.email
+		WHERE k.email = $1 AND k.revoked_at IS NULL ORDER BY k.created DESC`, lookupEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+//TouchAPIKey records that a key has just been used
+func (db *DBManager) TouchAPIKey(ctx context.Context, id int) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.TouchAPIKey", "UPDATE")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `UPDATE api_keys SET last_used = current_timestamp WHERE id = $1;`, id)
+	return err
+}
+
+//RevokeAPIKey revokes one of a user's keys, or returns ErrAPIKeyNonexistant if the user has no such key
+func (db *DBManager) RevokeAPIKey(ctx context.Context, email string, id int) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.RevokeAPIKey", "UPDATE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx,
+		`UPDATE api_keys SET revoked_at = current_timestamp WHERE id = $1 AND email = $2 AND revoked_at IS NULL;`, id, lookupEmail(email))
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return ErrAPIKeyNonexistant
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expires, lastUsed sql.NullTime
+	err := row.Scan(&key.ID, &key.Email, &key.Role, &key.Name, &key.Prefix, &scopes, &expires, &lastUsed, &key.Created)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	if expires.Valid {
+		key.Expires = &expires.Time
+	}
+	if lastUsed.Valid {
+		key.LastUsed = &lastUsed.Time
+	}
+	return key, nil
+}
+
+func (db *DBManager) initSchemaAPIKeys(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS api_keys(
+			 id serial PRIMARY KEY,
+			 email VARCHAR (254) NOT NULL REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+			 name VARCHAR (128) NOT NULL,
+			 prefix VARCHAR (16) NOT NULL,
+			 hash CHAR (64) UNIQUE NOT NULL,
+			 scopes TEXT NOT NULL,
+			 expires TIMESTAMP,
+			 last_used TIMESTAMP,
+			 revoked_at TIMESTAMP,
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 );
+		CREATE INDEX IF NOT EXISTS api_keys_email_idx ON api_keys (email);`,
+	)
+	return err
+}
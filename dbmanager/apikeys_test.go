@@ -0,0 +1,77 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestListAPIKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	expires := time.Now().Add(time.Hour)
+	rows := sqlmock.NewRows([]string{"id", "email", "role", "name", "prefix", "scopes", "expires", "last_used", "created"}).
+		AddRow(2, "user@gmail.com", "user", "ci", "iotd_abcdefgh", "audit:read keys:read", expires, nil, time.Now()).
+		AddRow(1, "user@gmail.com", "user", "old", "iotd_12345678", "keys:read", nil, time.Now(), time.Now())
+	mock.ExpectQuery(regexp.QuoteMeta("FROM api_keys k JOIN users u ON u.email = k.email")).
+		WithArgs("user@gmail.com").WillReturnRows(rows)
+
+	//keys are found whatever the case of the address
+	keys, err := PSQL.ListAPIKeys(context.Background(), "User@GMail.com")
+	if err != nil {
+		t.Fatalf("Listing API keys failed: %v \n", err)
+	}
+	if len(keys) != 2 || len(keys[0].Scopes) != 2 || keys[0].Expires == nil || keys[0].LastUsed != nil {
+		t.Errorf("Unexpected keys: %+v", keys)
+	}
+	if keys[1].Expires != nil || keys[1].LastUsed == nil {
+		t.Errorf("Nullable columns were not scanned: %+v", keys[1])
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("UPDATE api_keys SET revoked_at = current_timestamp")
+	mock.ExpectExec(query).WithArgs(1, "user@gmail.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(1, "other@gmail.com").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(query).WithArgs(2, "user@gmail.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := PSQL.RevokeAPIKey(context.Background(), "user@gmail.com", 1); err != nil {
+		t.Errorf("Revoking own key failed: %v", err)
+	}
+	if err := PSQL.RevokeAPIKey(context.Background(), "other@gmail.com", 1); err != ErrAPIKeyNonexistant {
+		t.Errorf("Expected ErrAPIKeyNonexistant revoking another user's key, got: %v", err)
+	}
+	if err := PSQL.RevokeAPIKey(context.Background(), "User@GMail.com", 2); err != nil {
+		t.Errorf("Revoking own key with a mixed case address failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,152 @@
+package dbmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of security relevant events recorded in the audit_events table
+const (
+	AuditLoginSuccess   = "login_success"
+	AuditLoginFailure   = "login_failure"
+	AuditLogout         = "logout"
+	AuditPasswordChange = "password_change"
+	AuditRoleChange     = "role_change"
+	AuditLockout        = "lockout"
+	AuditAPIKeyCreate   = "api_key_create"
+	AuditAPIKeyRevoke   = "api_key_revoke"
+	AuditOAuthClient    = "oauth_client_register"
+	AuditOAuthConsent   = "oauth_consent"
+	AuditUserCreate     = "user_create"
+	AuditUserDisable    = "user_disable"
+	AuditUserEnable     = "user_enable"
+	AuditUserDelete     = "user_delete"
+	AuditUserPurge      = "user_purge"
+	AuditSessionsRevoke = "sessions_revoke"
+	AuditUserInvite     = "user_invite"
+	AuditUserVerify     = "user_verify"
+	AuditRegister       = "register"
+	AuditRegisterReject = "register_reject"
+	AuditUsernameChange = "username_change"
+)
+
+// AuditEvent is a single row of the audit_events table
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+	Created   time.Time `json:"created"`
+}
+
+// AuditFilter narrows down the events returned by QueryAuditEvents. Zero values are ignored.
+type AuditFilter struct {
+	Email    string
+	From, To time.Time
+	Limit    int
+}
+
+// Lengths of the audit_events columns that hold values submitted by clients
+const (
+	auditEmailLength = 254
+	auditIPLength    = 45
+)
+
+//RecordAuditEvent stores an event in the audit log. The email and IP address are cut to the length of their columns,
+//since they may be whatever a client submitted, e.g. as the login of a failed login, and must not keep the event from
+//being recorded.
+func (db *DBManager) RecordAuditEvent(ctx context.Context, ev AuditEvent) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.RecordAuditEvent", "INSERT")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO audit_events(type,email,ip,user_agent,reason) VALUES ($1 , $2 , $3 , $4 , $5);`,
+		ev.Type, truncateText(ev.Email, auditEmailLength), truncateText(ev.IP, auditIPLength),
+		truncateText(ev.UserAgent, -1), truncateText(ev.Reason, -1))
+	return err
+}
+
+// truncateText makes s storable in a text column of n characters, or of any length if n is negative: invalid UTF-8
+// and NUL characters, which Postgres rejects, are replaced and whatever exceeds n characters is cut off
+func truncateText(s string, n int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "\uFFFD")
+	if n < 0 {
+		return s
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+//QueryAuditEvents returns the audit events matching the filter, newest first
+func (db *DBManager) QueryAuditEvents(ctx context.Context, f AuditFilter) (_ []AuditEvent, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.QueryAuditEvents", "SELECT")
+	defer end(&err)
+
+	var conditions []string
+	var args []interface{}
+	if f.Email != "" {
+		args = append(args, lookupEmail(f.Email))
+		conditions = append(conditions, fmt.Sprintf("email = $%d", len(args)))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		conditions = append(conditions, fmt.Sprintf("created >= $%d", len(args)))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		conditions = append(conditions, fmt.Sprintf("created < $%d", len(args)))
+	}
+
+	query := `SELECT id, type, email, ip, user_agent, reason, created FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created DESC"
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var ev AuditEvent
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.Email, &ev.IP, &ev.UserAgent, &ev.Reason, &ev.Created); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (db *DBManager) initSchemaAuditEvents(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS audit_events(
+			 id bigserial PRIMARY KEY,
+			 type VARCHAR (32) NOT NULL,
+			 email VARCHAR (254) NOT NULL,
+			 ip VARCHAR (45) NOT NULL,
+			 user_agent TEXT NOT NULL,
+			 reason TEXT NOT NULL,
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 )`,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS audit_events_email_created_idx ON audit_events (email, created)`)
+	return err
+}
@@ -0,0 +1,116 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRecordAuditEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	ev := AuditEvent{Type: AuditLoginFailure, Email: "user@gmail.com", IP: "10.0.0.1", UserAgent: "curl/7.64", Reason: "bad password"}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events(type,email,ip,user_agent,reason) VALUES ($1 , $2 , $3 , $4 , $5);")).
+		WithArgs(ev.Type, ev.Email, ev.IP, ev.UserAgent, ev.Reason).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := PSQL.RecordAuditEvent(context.Background(), ev); err != nil {
+		t.Errorf("Recording audit event failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRecordAuditEventTruncates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	//a failed login is audited under whatever login the client submitted
+	login := strings.Repeat("é", 300) + "@gmail.com"
+	ev := AuditEvent{Type: AuditLoginFailure, Email: login, IP: "10.0.0.1", UserAgent: "curl\x00/7.64", Reason: "bad \xffpassword"}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events(type,email,ip,user_agent,reason) VALUES ($1 , $2 , $3 , $4 , $5);")).
+		WithArgs(ev.Type, strings.Repeat("é", 254), ev.IP, "curl\uFFFD/7.64", "bad \uFFFDpassword").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := PSQL.RecordAuditEvent(context.Background(), ev); err != nil {
+		t.Errorf("Recording audit event failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestQueryAuditEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	columns := []string{"id", "type", "email", "ip", "user_agent", "reason", "created"}
+
+	cases := []struct {
+		filter AuditFilter
+		query  string
+		args   int
+	}{
+		{AuditFilter{}, "SELECT id, type, email, ip, user_agent, reason, created FROM audit_events ORDER BY created DESC", 0},
+		{AuditFilter{Email: "user@gmail.com"}, "FROM audit_events WHERE email = $1 ORDER BY created DESC", 1},
+		{AuditFilter{Email: "user@gmail.com", From: from, To: to, Limit: 10}, "WHERE email = $1 AND created >= $2 AND created < $3 ORDER BY created DESC LIMIT $4", 4},
+	}
+
+	for _, c := range cases {
+		rows := sqlmock.NewRows(columns).
+			AddRow(1, AuditLoginSuccess, "user@gmail.com", "10.0.0.1", "curl/7.64", "", from)
+		args := make([]driver.Value, c.args)
+		for i := range args {
+			args[i] = sqlmock.AnyArg()
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(c.query)).WithArgs(args...).WillReturnRows(rows)
+
+		events, err := PSQL.QueryAuditEvents(context.Background(), c.filter)
+		if err != nil {
+			t.Errorf("Querying audit events failed for %+v: %v", c.filter, err)
+			continue
+		}
+		if len(events) != 1 || events[0].Type != AuditLoginSuccess {
+			t.Errorf("Unexpected audit events for %+v: %+v", c.filter, events)
+		}
+	}
+}
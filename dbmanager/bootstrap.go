@@ -0,0 +1,76 @@
+package dbmanager
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrBootstrapDone = errors.New("Bootstrap has already been completed")
+
+//BootstrapPending reports whether the first admin still has to be created. Once bootstrap has completed, or users
+//existed when the schema was migrated, it stays disabled even if every user is removed later.
+func (db *DBManager) BootstrapPending(ctx context.Context) (pending bool, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.BootstrapPending", "SELECT")
+	defer end(&err)
+
+	err = db.DB.QueryRowContext(ctx,
+		`SELECT NOT EXISTS (SELECT 1 FROM bootstrap) AND NOT EXISTS (SELECT 1 FROM users)`).Scan(&pending)
+	return pending, err
+}
+
+//BootstrapAdmin creates the first admin and permanently disables bootstrap in a single transaction.
+//It returns ErrBootstrapDone if bootstrap has already completed or a user exists, e.g. when racing another instance.
+func (db *DBManager) BootstrapAdmin(ctx context.Context, email, password string) (err error) {
+	hashedPass, err := db.hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	ctx, end := db.startQuery(ctx, "DBManager.BootstrapAdmin", "INSERT")
+	defer end(&err)
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO bootstrap(id) VALUES (1) ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrBootstrapDone
+	}
+	var usersExist bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users)`).Scan(&usersExist); err != nil {
+		return err
+	}
+	if usersExist {
+		return ErrBootstrapDone
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO users(email,password,role) VALUES ($1 , $2 , $3);`, email, hashedPass, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.Logger.Info("Bootstrapped initial admin", "email", email)
+	return nil
+}
+
+// initSchemaBootstrap creates the table whose single row records that bootstrap has completed.
+// Deployments that already have users are marked as bootstrapped right away.
+func (db *DBManager) initSchemaBootstrap(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS bootstrap(
+			 id INTEGER PRIMARY KEY CHECK (id = 1),
+			 completed TIMESTAMP NOT NULL default current_timestamp
+			 )`,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO bootstrap(id) SELECT 1 WHERE EXISTS (SELECT 1 FROM users) ON CONFLICT DO NOTHING`)
+	return err
+}
@@ -0,0 +1,64 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	cases := []struct {
+		marked, usersExist bool
+		err                error
+	}{
+		{true, false, nil},
+		//another instance completed bootstrap first
+		{false, false, ErrBootstrapDone},
+		//users were added without bootstrap
+		{true, true, ErrBootstrapDone},
+	}
+
+	for _, c := range cases {
+		mock.ExpectBegin()
+		marked := int64(0)
+		if c.marked {
+			marked = 1
+		}
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO bootstrap(id) VALUES (1) ON CONFLICT DO NOTHING;")).
+			WillReturnResult(sqlmock.NewResult(0, marked))
+		if c.marked {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM users)")).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(c.usersExist))
+		}
+		if c.err == nil {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role) VALUES ($1 , $2 , $3);")).
+				WithArgs("admin@gmail.com", sqlmock.AnyArg(), RoleAdmin).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		if err := PSQL.BootstrapAdmin(context.Background(), "admin@gmail.com", "S3cure3Pa$$"); err != c.err {
+			t.Errorf("Bootstrap with marked=%v usersExist=%v returned %v, want %v", c.marked, c.usersExist, err, c.err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
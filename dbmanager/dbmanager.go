@@ -1,89 +1,533 @@
 package dbmanager
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"iotdashboard/passwords"
+	"iotdashboard/tracing"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq" //db driver for postgres
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("iotdashboard/dbmanager")
+
 var ErrUserNonexistant = errors.New("User does not exist")
 
+// Roles that can be assigned to a user
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Account states of a user. Disabled users can neither log in nor use their API keys or sessions.
+// Invited users cannot log in until they accept their invitation by choosing a password.
+// Deleted users are treated like users that do not exist until they are purged, see DeleteUser.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	StatusInvited  = "invited"
+	StatusDeleted  = "deleted"
+)
+
+// User is the non-secret part of a row in the users table
+type User struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	// Username is an optional alternative to the email for logging in
+	Username string `json:"username,omitempty"`
+	Role     string `json:"role"`
+	Status   string `json:"status"`
+	// Verified is when the user proved to own the email address by accepting an invitation
+	Verified *time.Time `json:"verified,omitempty"`
+	Created  time.Time  `json:"created"`
+}
+
+// Options configures the connection to Postgres and its pool
+type Options struct {
+	// DSN is a postgres:// URL or key=value connection string. When set, it replaces Host through SSLKey.
+	DSN      string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	// SSLMode is "disable", "require", "verify-ca" or "verify-full"
+	SSLMode string
+	// SSLRootCert is a PEM bundle of CAs trusted for the server certificate
+	SSLRootCert string
+	// SSLCert and SSLKey are an optional client certificate presented to the server
+	SSLCert string
+	SSLKey  string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// StartupTimeout is how long the first connection is retried, with back-off, before giving up. Zero tries once.
+	StartupTimeout time.Duration
+	// QueryTimeout bounds every database operation on top of the caller's context. Zero disables it.
+	QueryTimeout time.Duration
+	// Hasher hashes new passwords. Stored hashes it would not produce are replaced when their user logs in.
+	// Nil hashes with bcrypt at the default cost.
+	Hasher passwords.Hasher
+	// LockoutThreshold is how many wrong passwords in a row lock an account for LockoutDuration. Zero disables lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// HashConcurrency is how many passwords are hashed or verified at once, and HashQueue how many more may wait.
+	// They configure the HashLimiter set up by the controller; zero picks a value from the number of CPUs.
+	HashConcurrency int
+	HashQueue       int
+}
+
+// DefaultOptions connects to the database of the docker-compose setup
+func DefaultOptions() Options {
+	return Options{
+		Host:             "db",
+		Port:             "5432",
+		User:             "postgres",
+		Password:         "postgres",
+		Name:             "iot_dashboard",
+		SSLMode:          "disable",
+		MaxOpenConns:     25,
+		MaxIdleConns:     5,
+		ConnMaxLifetime:  30 * time.Minute,
+		ConnMaxIdleTime:  5 * time.Minute,
+		StartupTimeout:   time.Minute,
+		QueryTimeout:     5 * time.Second,
+		LockoutThreshold: 5,
+		LockoutDuration:  15 * time.Minute,
+	}
+}
+
+// dsn returns the connection string for lib/pq
+func (o Options) dsn() (string, error) {
+	if o.DSN != "" {
+		return o.DSN, nil
+	}
+	switch o.SSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return "", fmt.Errorf("Unsupported Postgres sslmode %q", o.SSLMode)
+	}
+	params := []string{
+		"host", o.Host, "port", o.Port, "user", o.User, "password", o.Password, "dbname", o.Name,
+		"sslmode", o.SSLMode, "sslrootcert", o.SSLRootCert, "sslcert", o.SSLCert, "sslkey", o.SSLKey,
+	}
+	var parts []string
+	for i := 0; i < len(params); i += 2 {
+		if params[i+1] != "" {
+			parts = append(parts, params[i]+"="+quoteDSNValue(params[i+1]))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// quoteDSNValue quotes a key=value connection string value so that spaces and quotes survive, e.g. in passwords
+func quoteDSNValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
 type DBManager struct {
-	dbUser, dbPass, dbName string
-	DB                     *sql.DB
+	DB     *sql.DB
+	Logger *slog.Logger
+	// QueryTimeout bounds every database operation on top of the caller's context. Zero disables it.
+	QueryTimeout time.Duration
+	Hasher       passwords.Hasher
+	// HashLimiter, if set, bounds how many passwords are hashed or verified at once. Only the hashing itself holds a
+	// slot, never a database query.
+	HashLimiter HashLimiter
+	// LockoutThreshold is how many wrong passwords in a row lock an account for LockoutDuration. Zero disables lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	migrated         bool
+
+	dummyMu sync.Mutex
+	dummy   struct {
+		hasher passwords.Hasher
+		hash   string
+	}
 }
 
-//New creates a new DBManager instance and returns it
-func New(user, pass, name string) (*DBManager, error) {
-	d := DBManager{dbUser: user, dbPass: pass, dbName: name}
-	err := d.connectToPSQL()
+//New connects to the docker-compose database as user with pass, using the database name, and returns a DBManager
+func New(user, pass, name string, logger *slog.Logger) (*DBManager, error) {
+	opts := DefaultOptions()
+	opts.User, opts.Password, opts.Name = user, pass, name
+	return Open(context.Background(), opts, logger)
+}
+
+//Open connects to the database described by opts, migrates its schema and returns a DBManager
+func Open(ctx context.Context, opts Options, logger *slog.Logger) (*DBManager, error) {
+	d := DBManager{Logger: logger, QueryTimeout: opts.QueryTimeout, Hasher: opts.Hasher,
+		LockoutThreshold: opts.LockoutThreshold, LockoutDuration: opts.LockoutDuration}
+	if d.Hasher == nil {
+		d.Hasher = passwords.Bcrypt{Cost: passwords.DefaultBcryptCost}
+	}
+	err := d.connectToPSQL(ctx, opts)
 	return &d, err
 }
 
-func (db *DBManager) getPasswordHash(email string) ([]byte, error) {
-	result := db.DB.QueryRow(`SELECT password from users WHERE email = $1`, email)
+// startQuery starts a client span for a database operation such as SELECT or INSERT, bounded by QueryTimeout.
+// The returned function must be deferred with the method's error: it ends the span and, if the context ended the
+// operation, wraps the error so that errors.Is reports context.DeadlineExceeded or context.Canceled,
+// which the driver does not always return itself.
+func (db *DBManager) startQuery(ctx context.Context, name, operation string) (context.Context, func(*error)) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation),
+	))
+	cancel := context.CancelFunc(func() {})
+	if db.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, db.QueryTimeout)
+	}
+	return ctx, func(err *error) {
+		if *err != nil && ctx.Err() != nil && !errors.Is(*err, ctx.Err()) {
+			*err = fmt.Errorf("%w: %v", ctx.Err(), *err)
+		}
+		cancel()
+		tracing.End(span, *err)
+	}
+}
+
+//GetUser returns the user with the given email, or ErrUserNonexistant if there is none
+func (db *DBManager) GetUser(ctx context.Context, email string) (_ User, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetUser", "SELECT")
+	defer end(&err)
+
+	result := db.DB.QueryRowContext(ctx, `SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1`, lookupEmail(email))
+
+	var u User
+	if err := result.Scan(&u.ID, &u.Email, &u.Username, &u.Role, &u.Status, &u.Verified, &u.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrUserNonexistant
+		}
+		return User{}, err
+	}
+	return u, nil
+}
+
+//SetUserPassword replaces the stored password hash of an existing user and lifts any lockout
+func (db *DBManager) SetUserPassword(ctx context.Context, email, password string) (err error) {
+	hashedPass, err := db.hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	ctx, end := db.startQuery(ctx, "DBManager.SetUserPassword", "UPDATE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET password = $2, failed_logins = 0, locked_until = NULL WHERE email = $1;`, lookupEmail(email), hashedPass)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//SetUserRole assigns a role to an existing user
+func (db *DBManager) SetUserRole(ctx context.Context, email, role string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.SetUserRole", "UPDATE")
+	defer end(&err)
 
-	var hash []byte
-	if err := result.Scan(&hash); err != nil {
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET role = $2 WHERE email = $1;`, lookupEmail(email), role)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//ListUsers returns all users in the order they were added
+func (db *DBManager) ListUsers(ctx context.Context) (_ []User, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.ListUsers", "SELECT")
+	defer end(&err)
+
+	rows, err := db.DB.QueryContext(ctx, `SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users ORDER BY uid`)
+	if err != nil {
 		return nil, err
 	}
-	return hash, nil
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Username, &u.Role, &u.Status, &u.Verified, &u.Created); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+//DisableUser stops an active user from logging in and revokes their sessions.
+//It returns ErrUserNonexistant if there is no active user with the given email, so deleted users stay deleted
+//and are still purged, and pending invitations are left alone.
+func (db *DBManager) DisableUser(ctx context.Context, email string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.DisableUser", "UPDATE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET status = $2, sessions_revoked_at = $3 WHERE email = $1 AND status = $4;`,
+		lookupEmail(email), StatusDisabled, time.Now().UTC(), StatusActive)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//EnableUser lets a disabled or deleted user log in again. Sessions and API keys revoked in the meantime stay revoked.
+//It returns ErrUserNonexistant if there is no disabled or deleted user with the given email.
+func (db *DBManager) EnableUser(ctx context.Context, email string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.EnableUser", "UPDATE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET status = $2, deleted_at = NULL WHERE email = $1 AND status IN ($3, $4);`,
+		lookupEmail(email), StatusActive, StatusDisabled, StatusDeleted)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//RevokeSessions invalidates every token issued to a user up to now
+func (db *DBManager) RevokeSessions(ctx context.Context, email string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.RevokeSessions", "UPDATE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET sessions_revoked_at = $2 WHERE email = $1;`, lookupEmail(email), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//SessionState returns when the sessions of a user were last revoked, the zero time if they never were, and whether
+//the user is active and may use them at all. A user that does not exist, for example because it was purged, is
+//reported as inactive.
+func (db *DBManager) SessionState(ctx context.Context, email string) (revoked time.Time, active bool, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.SessionState", "SELECT")
+	defer end(&err)
+
+	var revokedAt sql.NullTime
+	var status string
+	err = db.DB.QueryRowContext(ctx, `SELECT sessions_revoked_at, status from users WHERE email = $1`, lookupEmail(email)).Scan(&revokedAt, &status)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return revokedAt.Time, status == StatusActive, nil
 }
 
-//CheckUserCredentials returns an Error if the supplied credentials do not match any row in the database.
-func (db *DBManager) CheckUserCredentials(email, password string) error {
-	hash, err := db.getPasswordHash(email)
+func expectOneRow(result sql.Result) error {
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if n == 0 {
+		return ErrUserNonexistant
+	}
+	return nil
 }
 
-//AddNewUser returns an Error if the user is not successfully added to DB
-func (db *DBManager) AddNewUser(email, password string) error {
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+//AddNewUser returns an Error if the user is not successfully added to DB, or ErrInvalidEmail if email is not a valid address.
+//The email is stored in the form returned by NormalizeEmail.
+func (db *DBManager) AddNewUser(ctx context.Context, email, password string) (err error) {
+	email, err = NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	hashedPass, err := db.hashPassword(ctx, password)
 	if err != nil {
 		return err
 	}
+	ctx, end := db.startQuery(ctx, "DBManager.AddNewUser", "INSERT")
+	defer end(&err)
 
-	_, err = db.DB.Exec(`INSERT INTO users(email,password) VALUES ($1 , $2);`, email, hashedPass)
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO users(email,password) VALUES ($1 , $2);`, email, hashedPass)
 	if err != nil {
 		return err
 	}
+	db.Logger.Info("Added new user", "email", email)
 	return nil
 }
 
+//Ping returns an error if the database cannot be reached
+func (db *DBManager) Ping(ctx context.Context) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.Ping", "PING")
+	defer end(&err)
+	return db.DB.PingContext(ctx)
+}
+
+//Migrated reports whether the schema has been brought up to date
+func (db *DBManager) Migrated() bool {
+	return db.migrated
+}
+
+// Back-off between attempts to reach the database on startup
+var (
+	retryInitialBackoff = 500 * time.Millisecond
+	retryMaxBackoff     = 10 * time.Second
+)
+
 //ConnectToPSQL returns an error if the connection to the DB is not successful
-func (db *DBManager) connectToPSQL() error {
-	dbinfo := fmt.Sprintf("host=db port=5432 user=%s password=%s dbname=%s sslmode=disable",
-		db.dbUser, db.dbPass, db.dbName)
+func (db *DBManager) connectToPSQL(ctx context.Context, opts Options) error {
+	dbinfo, err := opts.dsn()
+	if err != nil {
+		return err
+	}
 	psql, err := sql.Open("postgres", dbinfo)
 
 	if err != nil {
 		return err
 	}
+	psql.SetMaxOpenConns(opts.MaxOpenConns)
+	psql.SetMaxIdleConns(opts.MaxIdleConns)
+	psql.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	psql.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
 	db.DB = psql
+
+	// sql.Open does not connect, so wait for a database that is still starting up before migrating
+	if err := db.waitForConnection(ctx, opts.StartupTimeout); err != nil {
+		db.Logger.Error("Failed to connect to the database", "error", err)
+		return err
+	}
 	// only creates the table if it doesn't already exist
 	// Typically this database would exist on its own outside of docker
-	err = db.initSchemaUsers()
+	err = db.initSchemaUsers(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize users schema", "error", err)
+		return err
+	}
+	err = db.initSchemaAuditEvents(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize audit_events schema", "error", err)
+		return err
+	}
+	err = db.initSchemaServicePrincipals(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize service_principals schema", "error", err)
+		return err
+	}
+	err = db.initSchemaAPIKeys(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize api_keys schema", "error", err)
+		return err
+	}
+	err = db.initSchemaOAuth(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize OAuth schema", "error", err)
+		return err
+	}
+	err = db.initSchemaInvitations(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize invitations schema", "error", err)
+		return err
+	}
+	err = db.initSchemaRegistrations(ctx)
 	if err != nil {
+		db.Logger.Error("Failed to initialize registrations schema", "error", err)
 		return err
 	}
+	err = db.migrateEmails(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to normalize email addresses", "error", err)
+		return err
+	}
+	err = db.initSchemaBootstrap(ctx)
+	if err != nil {
+		db.Logger.Error("Failed to initialize bootstrap schema", "error", err)
+		return err
+	}
+	db.migrated = true
 
 	return nil
 }
 
-func (db *DBManager) initSchemaUsers() error {
-	_, err := db.DB.Exec(`
+// waitForConnection pings the database until it answers, retrying with exponential back-off for up to timeout
+func (db *DBManager) waitForConnection(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := db.DB.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) < backoff {
+			return fmt.Errorf("Database unreachable after %d attempts: %w", attempt, err)
+		}
+		db.Logger.Warn("Database not reachable yet, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("Database unreachable after %d attempts: %w", attempt, err)
+		}
+		backoff = min(2*backoff, retryMaxBackoff)
+	}
+}
+
+func (db *DBManager) initSchemaUsers(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS users(
 			 uid serial PRIMARY KEY,
 			 email VARCHAR (254) UNIQUE NOT NULL,
-			 password VARCHAR (60) NOT NULL,
+			 password VARCHAR (255) NOT NULL,
 			 created TIMESTAMP NOT NULL default current_timestamp
 			 )`,
 	)
+	if err != nil {
+		return err
+	}
+	// bcrypt hashes fit in 60 characters, Argon2id's PHC strings do not. Changing the type rewrites the table under an
+	// exclusive lock, so it is only done once for tables created with the old width.
+	var passwordLength sql.NullInt64
+	err = db.DB.QueryRowContext(ctx, `SELECT character_maximum_length FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'password'`).Scan(&passwordLength)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if passwordLength.Valid && passwordLength.Int64 < 255 {
+		_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ALTER COLUMN password TYPE VARCHAR (255)`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR (32) NOT NULL DEFAULT 'user'`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR (16) NOT NULL DEFAULT 'active'`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS sessions_revoked_at TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE users ADD COLUMN IF NOT EXISTS username VARCHAR (%d) UNIQUE`, MaxUsernameLength))
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins INTEGER NOT NULL DEFAULT 0`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`)
 	return err
 }
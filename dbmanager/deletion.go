@@ -0,0 +1,68 @@
+package dbmanager
+
+import (
+	"context"
+	"time"
+)
+
+//DeleteUser soft deletes a user: the account is marked as deleted, its sessions and API keys are revoked and its
+//pending OAuth authorization codes and invitations are removed. The row itself is kept, so that EnableUser can restore
+//the account, until PurgeDeletedUsers removes it. Until then the email address and username stay taken.
+//It returns ErrUserNonexistant if there is no such user or they are already deleted.
+func (db *DBManager) DeleteUser(ctx context.Context, email string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.DeleteUser", "UPDATE")
+	defer end(&err)
+
+	email = lookupEmail(email)
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.ExecContext(ctx, `UPDATE users SET status = $2, deleted_at = $3, sessions_revoked_at = $3 WHERE email = $1 AND status <> $2;`,
+		email, StatusDeleted, now)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $2 WHERE email = $1 AND revoked_at IS NULL;`, email, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE email = $1;`, email); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE email = $1;`, email); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.Logger.InfoContext(ctx, "Deleted user", "email", email)
+	return nil
+}
+
+//PurgeDeletedUsers permanently removes the users deleted before the given time, along with their API keys, invitations
+//and authorization codes, and returns their email addresses. The audit log keeps its events about them.
+func (db *DBManager) PurgeDeletedUsers(ctx context.Context, before time.Time) (_ []string, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.PurgeDeletedUsers", "DELETE")
+	defer end(&err)
+
+	rows, err := db.DB.QueryContext(ctx, `DELETE FROM users WHERE status = $1 AND deleted_at < $2 RETURNING email`, StatusDeleted, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
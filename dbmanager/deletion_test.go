@@ -0,0 +1,182 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeleteUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = $2, deleted_at = $3, sessions_revoked_at = $3 WHERE email = $1 AND status <> $2;")).
+		WithArgs("user@gmail.com", StatusDeleted, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE api_keys SET revoked_at = $2 WHERE email = $1 AND revoked_at IS NULL;")).
+		WithArgs("user@gmail.com", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM oauth_codes WHERE email = $1;")).
+		WithArgs("user@gmail.com").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations WHERE email = $1;")).
+		WithArgs("user@gmail.com").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	if err := PSQL.DeleteUser(context.Background(), "User@Gmail.com"); err != nil {
+		t.Errorf("Deleting user failed: %v", err)
+	}
+
+	//unknown and already deleted users are left alone
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = $2")).
+		WithArgs("nobody@gmail.com", StatusDeleted, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := PSQL.DeleteUser(context.Background(), "nobody@gmail.com"); err != ErrUserNonexistant {
+		t.Errorf("Deleting an unknown user returned %v, want %v", err, ErrUserNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("UPDATE users SET status = $2, sessions_revoked_at = $3 WHERE email = $1 AND status = $4;")
+	mock.ExpectExec(query).WithArgs("user@gmail.com", StatusDisabled, sqlmock.AnyArg(), StatusActive).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := PSQL.DisableUser(context.Background(), "user@gmail.com"); err != nil {
+		t.Errorf("Disabling user failed: %v", err)
+	}
+	//a deleted user must keep its deleted status so that it is still purged
+	mock.ExpectExec(query).WithArgs("deleted@gmail.com", StatusDisabled, sqlmock.AnyArg(), StatusActive).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := PSQL.DisableUser(context.Background(), "deleted@gmail.com"); err != ErrUserNonexistant {
+		t.Errorf("Disabling a deleted user returned %v, want %v", err, ErrUserNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEnableUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("UPDATE users SET status = $2, deleted_at = NULL WHERE email = $1 AND status IN ($3, $4);")
+	mock.ExpectExec(query).WithArgs("user@gmail.com", StatusActive, StatusDisabled, StatusDeleted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := PSQL.EnableUser(context.Background(), "user@gmail.com"); err != nil {
+		t.Errorf("Enabling user failed: %v", err)
+	}
+	mock.ExpectExec(query).WithArgs("invited@gmail.com", StatusActive, StatusDisabled, StatusDeleted).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := PSQL.EnableUser(context.Background(), "invited@gmail.com"); err != ErrUserNonexistant {
+		t.Errorf("Enabling a user who is neither disabled nor deleted returned %v, want %v", err, ErrUserNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	before := time.Now().Add(-24 * time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM users WHERE status = $1 AND deleted_at < $2 RETURNING email")).
+		WithArgs(StatusDeleted, before.UTC()).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("old@gmail.com").AddRow("older@gmail.com"))
+	emails, err := PSQL.PurgeDeletedUsers(context.Background(), before)
+	if err != nil {
+		t.Fatalf("Purging deleted users failed: %v \n", err)
+	}
+	if len(emails) != 2 || emails[0] != "old@gmail.com" || emails[1] != "older@gmail.com" {
+		t.Errorf("Purged %v, want old@gmail.com and older@gmail.com", emails)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	cases := []struct {
+		row     []interface{}
+		revoked time.Time
+		active  bool
+	}{
+		{[]interface{}{nil, StatusActive}, time.Time{}, true},
+		{[]interface{}{revokedAt, StatusDisabled}, revokedAt, false},
+		{[]interface{}{revokedAt, StatusDeleted}, revokedAt, false},
+		//purged users are gone
+		{nil, time.Time{}, false},
+	}
+
+	for _, c := range cases {
+		rows := sqlmock.NewRows([]string{"sessions_revoked_at", "status"})
+		if c.row != nil {
+			rows.AddRow(c.row[0], c.row[1])
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).WillReturnRows(rows)
+		revoked, active, err := PSQL.SessionState(context.Background(), "user@gmail.com")
+		if err != nil || !revoked.Equal(c.revoked) || active != c.active {
+			t.Errorf("Session state of %v is %v, %v, %v", c.row, revoked, active, err)
+		}
+	}
+}
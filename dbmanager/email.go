@@ -0,0 +1,187 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrInvalidEmail = errors.New("Invalid email address")
+
+// ErrEmailCollision is returned by the migration when several users' emails only differ in case or Unicode form
+var ErrEmailCollision = errors.New("Users exist whose email addresses only differ in case")
+
+// Limits of RFC 5321 on the parts of an address
+const (
+	maxLocalPartLength = 64
+	maxEmailLength     = 254
+)
+
+// tables whose email column references users(email)
+var emailReferences = []string{"api_keys", "invitations", "oauth_codes"}
+
+//NormalizeEmail validates a bare RFC 5322 address, without display name or comments, and returns its canonical form:
+//the local part in Unicode NFC and lower case, and the domain in lower case ASCII, with internationalized domain names
+//converted to punycode. Every address is stored and looked up in this form, so addresses differing only in case match.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", fmt.Errorf("%w %q", ErrInvalidEmail, email)
+	}
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	domain, err = NormalizeDomain(domain)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidEmail, email, err)
+	}
+	local = strings.ToLower(norm.NFC.String(local))
+	if len(local) > maxLocalPartLength || len(local)+1+len(domain) > maxEmailLength {
+		return "", fmt.Errorf("%w %q: too long", ErrInvalidEmail, email)
+	}
+	return local + "@" + domain, nil
+}
+
+//NormalizeDomain returns the lower case ASCII form of a domain name, converting internationalized names to punycode
+func NormalizeDomain(domain string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// lookupEmail returns the form of an email users are stored under. Strings that are not valid addresses are
+// returned unchanged, so that they simply match no user.
+func lookupEmail(email string) string {
+	if normalized, err := NormalizeEmail(email); err == nil {
+		return normalized
+	}
+	return email
+}
+
+// migrateEmails rewrites the emails of existing users into their canonical form, along with the tables referencing
+// them and the audit log, so that the history of a user stays under one address, and adds a unique index on lower(email) as a safeguard against writes that bypass NormalizeEmail.
+// If the canonical forms of several users collide, nothing is changed and ErrEmailCollision lists them; they have to
+// be merged or renamed by hand before the server can start.
+// The index marks the migration as done, so that later starts skip reading every user and the whole audit log.
+func (db *DBManager) migrateEmails(ctx context.Context) error {
+	var done bool
+	err := db.DB.QueryRowContext(ctx, `SELECT to_regclass('users_email_lower_idx') IS NOT NULL`).Scan(&done)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT uid, email FROM users ORDER BY uid`)
+	if err != nil {
+		return err
+	}
+	owners := map[string][]string{}
+	renames := map[int][2]string{}
+	for rows.Next() {
+		var uid int
+		var email string
+		if err := rows.Scan(&uid, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			// kept as it is, the user can still be found by the exact address; the unique index still covers it
+			db.Logger.Warn("User has an invalid email address", "uid", uid, "email", email)
+			owners[strings.ToLower(email)] = append(owners[strings.ToLower(email)], email)
+			continue
+		}
+		owners[normalized] = append(owners[normalized], email)
+		if normalized != email {
+			renames[uid] = [2]string{email, normalized}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var collisions []string
+	for _, emails := range owners {
+		if len(emails) > 1 {
+			collisions = append(collisions, strings.Join(emails, " = "))
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("%w: %s", ErrEmailCollision, strings.Join(collisions, ", "))
+	}
+
+	if len(renames) > 0 {
+		// let renamed emails carry over to the referencing rows
+		for _, table := range emailReferences {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %[1]s DROP CONSTRAINT IF EXISTS %[1]s_email_fkey,
+				ADD CONSTRAINT %[1]s_email_fkey FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE`, table))
+			if err != nil {
+				return err
+			}
+		}
+		for uid, rename := range renames {
+			if _, err := tx.ExecContext(ctx, `UPDATE users SET email = $2 WHERE uid = $1;`, uid, rename[1]); err != nil {
+				return err
+			}
+			db.Logger.Info("Normalized email address", "uid", uid, "from", rename[0], "to", rename[1])
+		}
+	}
+	if err := db.migrateAuditEmails(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email))`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateAuditEmails rewrites the emails recorded in the audit log into their canonical form. Events may name
+// addresses no user has, e.g. of failed logins; those that are not valid addresses are left as they are.
+func (db *DBManager) migrateAuditEmails(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT email FROM audit_events`)
+	if err != nil {
+		return err
+	}
+	var renames [][2]string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return err
+		}
+		if normalized, err := NormalizeEmail(email); err == nil && normalized != email {
+			renames = append(renames, [2]string{email, normalized})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rename := range renames {
+		if _, err := tx.ExecContext(ctx, `UPDATE audit_events SET email = $2 WHERE email = $1;`, rename[0], rename[1]); err != nil {
+			return err
+		}
+	}
+	if len(renames) > 0 {
+		db.Logger.Info("Normalized email addresses in the audit log", "count", len(renames))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package dbmanager
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		email, want string
+		valid       bool
+	}{
+		{"user@gmail.com", "user@gmail.com", true},
+		{"  User.Name@GMail.COM ", "user.name@gmail.com", true},
+		{"first+tag@sub.example.org", "first+tag@sub.example.org", true},
+		//internationalized domains are stored as punycode
+		{"info@Bücher.de", "info@xn--bcher-kva.de", true},
+		{"info@xn--bcher-kva.de", "info@xn--bcher-kva.de", true},
+		//the composed and decomposed forms of é are the same address
+		{"Jos\u00e9@example.com", "jos\u00e9@example.com", true},
+		{"JOSE\u0301@example.com", "jos\u00e9@example.com", true},
+		{"", "", false},
+		{"user", "", false},
+		{"@gmail.com", "", false},
+		{"user@", "", false},
+		{"a@b@gmail.com", "", false},
+		{"User <user@gmail.com>", "", false},
+		{"<user@gmail.com>", "", false},
+		{"user@gmail.com (comment)", "", false},
+		{"user@exa mple.com", "", false},
+		{strings.Repeat("a", 65) + "@gmail.com", "", false},
+		{"user@" + strings.Repeat(strings.Repeat("a", 60)+".", 4) + "example.com", "", false},
+	}
+
+	for _, c := range cases {
+		got, err := NormalizeEmail(c.email)
+		if !c.valid {
+			if !errors.Is(err, ErrInvalidEmail) {
+				t.Errorf("NormalizeEmail(%q) returned %q, %v, want ErrInvalidEmail", c.email, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("NormalizeEmail(%q) returned %q, %v, want %q", c.email, got, err, c.want)
+		}
+	}
+}
+
+func TestMigrateEmails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	cases := []struct {
+		name    string
+		emails  []string
+		renames map[int]string
+		audit   []string
+		audited [][2]string
+		err     error
+	}{
+		{"normalized", []string{"a@gmail.com", "b@gmail.com"}, nil, []string{"a@gmail.com"}, nil, nil},
+		{"renamed", []string{"a@gmail.com", "B@GMail.com"}, map[int]string{2: "b@gmail.com"},
+			[]string{"B@GMail.com", "Nobody@Gmail.com", "not an email"},
+			[][2]string{{"B@GMail.com", "b@gmail.com"}, {"Nobody@Gmail.com", "nobody@gmail.com"}}, nil},
+		{"collision", []string{"a@gmail.com", "A@gmail.com", "b@gmail.com"}, nil, nil, nil, ErrEmailCollision},
+		//invalid addresses are kept exactly as they are
+		{"invalid", []string{"a@gmail.com", "Not An Email"}, nil, nil, nil, nil},
+	}
+
+	for _, c := range cases {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass('users_email_lower_idx') IS NOT NULL")).
+			WillReturnRows(sqlmock.NewRows([]string{"done"}).AddRow(false))
+		mock.ExpectBegin()
+		rows := sqlmock.NewRows([]string{"uid", "email"})
+		for i, email := range c.emails {
+			rows.AddRow(i+1, email)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email FROM users ORDER BY uid")).WillReturnRows(rows)
+		if c.err != nil {
+			mock.ExpectRollback()
+		} else {
+			if len(c.renames) > 0 {
+				for _, table := range emailReferences {
+					mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE " + table + " DROP CONSTRAINT IF EXISTS " + table + "_email_fkey")).
+						WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				for uid, email := range c.renames {
+					mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email = $2 WHERE uid = $1;")).
+						WithArgs(uid, email).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			audit := sqlmock.NewRows([]string{"email"})
+			for _, email := range c.audit {
+				audit.AddRow(email)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT email FROM audit_events")).WillReturnRows(audit)
+			for _, rename := range c.audited {
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE audit_events SET email = $2 WHERE email = $1;")).
+					WithArgs(rename[0], rename[1]).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectExec(regexp.QuoteMeta("CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email))")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+		}
+
+		err := PSQL.migrateEmails(context.Background())
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: migration returned %v, want %v", c.name, err, c.err)
+		}
+		if c.err != nil && (err == nil || !strings.Contains(err.Error(), "a@gmail.com = A@gmail.com")) {
+			t.Errorf("%s: error %v does not list the colliding addresses", c.name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", c.name, err)
+		}
+	}
+
+	//once the index exists, the migration is skipped
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass('users_email_lower_idx') IS NOT NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"done"}).AddRow(true))
+	if err := PSQL.migrateEmails(context.Background()); err != nil {
+		t.Errorf("Repeated migration returned %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
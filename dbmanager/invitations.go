@@ -0,0 +1,124 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrUserExists = errors.New("User already exists")
+
+var ErrInvitationNonexistant = errors.New("Invitation does not exist or has expired")
+
+// Invitation is a pending invitation. Only the SHA-256 hash of the token sent to the invitee is stored.
+type Invitation struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	Expires   time.Time `json:"expires"`
+	Created   time.Time `json:"created"`
+}
+
+//CreateInvitation adds an invited user who cannot log in yet, along with the invitation they accept with the token
+//hashed as hash. Inviting a user again replaces their previous invitation; inviting an existing user returns ErrUserExists.
+func (db *DBManager) CreateInvitation(ctx context.Context, inv Invitation, hash string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.CreateInvitation", "INSERT")
+	defer end(&err)
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// invited users have no password until they accept
+	result, err := tx.ExecContext(ctx, `INSERT INTO users(email,password,role,status) VALUES ($1 , '' , $2 , $3)
+		ON CONFLICT (email) DO UPDATE SET role = EXCLUDED.role WHERE users.status = $3;`, inv.Email, inv.Role, StatusInvited)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrUserExists
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE email = $1;`, inv.Email); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO invitations(email,hash,invited_by,expires) VALUES ($1 , $2 , $3 , $4);`,
+		inv.Email, hash, inv.InvitedBy, inv.Expires)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//GetInvitation returns the unexpired invitation with the given token hash, or ErrInvitationNonexistant
+func (db *DBManager) GetInvitation(ctx context.Context, hash string) (_ Invitation, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetInvitation", "SELECT")
+	defer end(&err)
+
+	var inv Invitation
+	err = db.DB.QueryRowContext(ctx, `SELECT i.email, u.role, i.invited_by, i.expires, i.created
+		FROM invitations i JOIN users u ON u.email = i.email WHERE i.hash = $1 AND i.expires > $2`, hash, time.Now().UTC()).
+		Scan(&inv.Email, &inv.Role, &inv.InvitedBy, &inv.Expires, &inv.Created)
+	if err == sql.ErrNoRows {
+		return Invitation{}, ErrInvitationNonexistant
+	}
+	return inv, err
+}
+
+//AcceptInvitation redeems the invitation with the given token hash: the invitation is deleted, so that it can only be
+//used once, and the invited user is activated with password and marked as verified. It returns the user's email.
+func (db *DBManager) AcceptInvitation(ctx context.Context, hash, password string) (_ string, err error) {
+	hashedPass, err := db.hashPassword(ctx, password)
+	if err != nil {
+		return "", err
+	}
+	ctx, end := db.startQuery(ctx, "DBManager.AcceptInvitation", "UPDATE")
+	defer end(&err)
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var email string
+	err = tx.QueryRowContext(ctx, `DELETE FROM invitations WHERE hash = $1 AND expires > $2 RETURNING email`, hash, now).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrInvitationNonexistant
+	}
+	if err != nil {
+		return "", err
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE users SET password = $2, status = $3, verified_at = $4 WHERE email = $1 AND status = $5;`,
+		email, hashedPass, StatusActive, now, StatusInvited)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// the user was disabled while the invitation was pending
+		return "", ErrInvitationNonexistant
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	db.Logger.Info("Invitation accepted", "email", email)
+	return email, nil
+}
+
+func (db *DBManager) initSchemaInvitations(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS invitations(
+			 id serial PRIMARY KEY,
+			 email VARCHAR (254) NOT NULL REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+			 hash CHAR (64) UNIQUE NOT NULL,
+			 invited_by VARCHAR (254) NOT NULL,
+			 expires TIMESTAMP NOT NULL,
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 );
+		CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations (email);`,
+	)
+	return err
+}
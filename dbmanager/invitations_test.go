@@ -0,0 +1,104 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateInvitation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	inv := Invitation{Email: "user@gmail.com", Role: RoleUser, InvitedBy: "admin@gmail.com", Expires: time.Now().Add(time.Hour)}
+	cases := []struct {
+		upserted int64
+		err      error
+	}{
+		{1, nil},
+		//an active or disabled user cannot be invited
+		{0, ErrUserExists},
+	}
+
+	for _, c := range cases {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).
+			WithArgs(inv.Email, inv.Role, StatusInvited).WillReturnResult(sqlmock.NewResult(0, c.upserted))
+		if c.err == nil {
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations WHERE email = $1;")).WithArgs(inv.Email).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations(email,hash,invited_by,expires)")).
+				WithArgs(inv.Email, "hash", inv.InvitedBy, inv.Expires).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+		if err := PSQL.CreateInvitation(context.Background(), inv, "hash"); err != c.err {
+			t.Errorf("Creating invitation returned %v, want %v", err, c.err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	consume := regexp.QuoteMeta("DELETE FROM invitations WHERE hash = $1 AND expires > $2 RETURNING email")
+	activate := regexp.QuoteMeta("UPDATE users SET password = $2, status = $3, verified_at = $4 WHERE email = $1 AND status = $5;")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(consume).WithArgs("hash", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	mock.ExpectExec(activate).WithArgs("user@gmail.com", sqlmock.AnyArg(), StatusActive, sqlmock.AnyArg(), StatusInvited).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	email, err := PSQL.AcceptInvitation(context.Background(), "hash", "S3cure3Pa$$")
+	if err != nil || email != "user@gmail.com" {
+		t.Errorf("Accepting invitation returned %q, %v", email, err)
+	}
+
+	//used, expired or unknown
+	mock.ExpectBegin()
+	mock.ExpectQuery(consume).WillReturnRows(sqlmock.NewRows([]string{"email"}))
+	mock.ExpectRollback()
+	if _, err := PSQL.AcceptInvitation(context.Background(), "hash", "S3cure3Pa$$"); err != ErrInvitationNonexistant {
+		t.Errorf("Accepting a used invitation returned %v, want %v", err, ErrInvitationNonexistant)
+	}
+
+	//the invitee was disabled in the meantime
+	mock.ExpectBegin()
+	mock.ExpectQuery(consume).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	mock.ExpectExec(activate).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if _, err := PSQL.AcceptInvitation(context.Background(), "other", "S3cure3Pa$$"); err != ErrInvitationNonexistant {
+		t.Errorf("Accepting the invitation of a disabled user returned %v, want %v", err, ErrInvitationNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
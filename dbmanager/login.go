@@ -0,0 +1,252 @@
+package dbmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"iotdashboard/passwords"
+	"iotdashboard/tracing"
+	"time"
+)
+
+// Reasons a login is rejected. They are meant for logs and the audit log only: clients must be given the same
+// answer for all of them, so that they cannot tell which accounts exist.
+var (
+	ErrBadPassword = errors.New("Wrong password")
+	// ErrLocked is returned while an account is locked after too many failed logins
+	ErrLocked = errors.New("Account is locked")
+	// ErrDisabled is returned for users who cannot log in, because they were disabled or have not accepted their invitation
+	ErrDisabled = errors.New("Account is disabled")
+)
+
+// HashLimiter bounds how many passwords are hashed or verified at once
+type HashLimiter interface {
+	// Acquire waits for a free slot and returns the function releasing it
+	Acquire(ctx context.Context) (release func(), err error)
+}
+
+type loginState struct {
+	hash        string
+	status      string
+	failed      int
+	lockedUntil sql.NullTime
+}
+
+func (db *DBManager) getLoginState(ctx context.Context, email string) (s loginState, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.getLoginState", "SELECT")
+	defer end(&err)
+
+	err = db.DB.QueryRowContext(ctx, `SELECT password, status, failed_logins, locked_until from users WHERE email = $1`, lookupEmail(email)).
+		Scan(&s.hash, &s.status, &s.failed, &s.lockedUntil)
+	if err == sql.ErrNoRows {
+		return s, ErrUserNonexistant
+	}
+	return s, err
+}
+
+//CheckUserCredentials returns nil if password is the password of the active user with the given email. Otherwise it
+//returns ErrUserNonexistant, which deleted users get as well, ErrBadPassword, ErrLocked or ErrDisabled, or an error
+//of the database. Every rejection takes as long as verifying a password and counting a failed login, so that
+//response times do not reveal which emails are registered either.
+//After LockoutThreshold wrong passwords in a row the account is locked for LockoutDuration; the error of the attempt
+//that locks it matches both ErrBadPassword and ErrLocked.
+//If the password matches but the stored hash uses another algorithm or other parameters than the Hasher, it is replaced.
+func (db *DBManager) CheckUserCredentials(ctx context.Context, email, password string) (err error) {
+	state, err := db.getLoginState(ctx, email)
+	if err != nil && err != ErrUserNonexistant {
+		return err
+	}
+	switch {
+	case err == ErrUserNonexistant || state.status == StatusDeleted:
+		if err := db.verifyForTiming(ctx, db.dummyHash(), password); err != nil {
+			return err
+		}
+		err = ErrUserNonexistant
+	case state.status != StatusActive:
+		if err := db.verifyForTiming(ctx, db.dummyHash(), password); err != nil {
+			return err
+		}
+		err = ErrDisabled
+	case state.lockedUntil.Valid && time.Now().UTC().Before(state.lockedUntil.Time):
+		// the password is still verified for the timing, but not even a correct one is accepted
+		if err := db.verifyForTiming(ctx, state.hash, password); err != nil {
+			return err
+		}
+		err = ErrLocked
+	default:
+		err = db.verifyPassword(ctx, state.hash, password)
+		if err == nil {
+			db.loginSucceeded(ctx, email, password, state)
+			return nil
+		}
+		if err != passwords.ErrMismatch {
+			return err
+		}
+		err = ErrBadPassword
+	}
+
+	// every rejection runs the update, which only counts wrong passwords of active and unlocked users
+	until, uerr := db.recordFailedLogin(ctx, email)
+	if uerr != nil {
+		db.Logger.WarnContext(ctx, "Failed to record failed login", "email", email, "error", uerr)
+	}
+	if !until.IsZero() {
+		return fmt.Errorf("%w: %w until %s", ErrBadPassword, ErrLocked, until.Format(time.RFC3339))
+	}
+	return err
+}
+
+// loginSucceeded clears the failed logins of a user who logged in and upgrades their password hash if needed
+func (db *DBManager) loginSucceeded(ctx context.Context, email, password string, state loginState) {
+	if state.failed > 0 || state.lockedUntil.Valid {
+		if err := db.resetFailedLogins(ctx, email); err != nil {
+			db.Logger.WarnContext(ctx, "Failed to reset failed logins", "email", email, "error", err)
+		}
+	}
+	if db.Hasher.NeedsRehash(state.hash) {
+		// the login succeeds regardless, the hash is upgraded at a later login instead
+		if err := db.rehashPassword(ctx, email, state.hash, password); err != nil {
+			db.Logger.WarnContext(ctx, "Failed to upgrade password hash", "email", email, "error", err)
+		}
+	}
+}
+
+//PasswordMatches reports whether password is the password of the active user with the given email. Unlike
+//CheckUserCredentials it neither counts failed logins nor upgrades the hash, so it is meant for checks made by the
+//server itself rather than logins.
+func (db *DBManager) PasswordMatches(ctx context.Context, email, password string) (bool, error) {
+	state, err := db.getLoginState(ctx, email)
+	if err == ErrUserNonexistant {
+		return false, nil
+	}
+	if err != nil || state.status != StatusActive {
+		return false, err
+	}
+	err = db.verifyPassword(ctx, state.hash, password)
+	if err == passwords.ErrMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *DBManager) verifyPassword(ctx context.Context, hash, password string) (err error) {
+	release, err := db.acquireHashSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, span := tracer.Start(ctx, "passwords.Verify")
+	defer func() { tracing.End(span, err) }()
+	return passwords.Verify(hash, password)
+}
+
+// verifyForTiming verifies a password only so that rejecting it takes as long as rejecting a wrong one. Whether it
+// matches does not matter; errors that kept it from being verified at all, e.g. of the HashLimiter, are returned.
+func (db *DBManager) verifyForTiming(ctx context.Context, hash, password string) error {
+	if err := db.verifyPassword(ctx, hash, password); err != passwords.ErrMismatch {
+		return err
+	}
+	return nil
+}
+
+// acquireHashSlot waits for a slot of the HashLimiter, if there is one, and returns the function releasing it
+func (db *DBManager) acquireHashSlot(ctx context.Context) (func(), error) {
+	if db.HashLimiter == nil {
+		return func() {}, nil
+	}
+	return db.HashLimiter.Acquire(ctx)
+}
+
+// fallbackDummyHash is a bcrypt hash of a discarded random password with DefaultBcryptCost, used as the dummy hash
+// if the Hasher fails to make one, so that unknown users are still rejected only after verifying a password
+const fallbackDummyHash = "$2a$10$J8AuZ4/lAkMZXzNbN7Nu9u3qvJZOzX/oMNWCnecoDC8AOsyxJ9CUG"
+
+// dummyHash returns a hash of a random password made by the current Hasher. Passwords of unknown and disabled
+// users are verified against it, so that rejecting them takes as long as rejecting a wrong password.
+func (db *DBManager) dummyHash() string {
+	db.dummyMu.Lock()
+	defer db.dummyMu.Unlock()
+	if db.dummy.hash != "" && db.dummy.hasher == db.Hasher {
+		return db.dummy.hash
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		db.Logger.Error("Failed to generate dummy password", "error", err)
+		return fallbackDummyHash
+	}
+	// made once per Hasher, so it bypasses the HashLimiter rather than failing a login when the queue is full
+	hash, err := db.Hasher.Hash(base64.RawURLEncoding.EncodeToString(random))
+	if err != nil {
+		db.Logger.Error("Failed to hash dummy password", "error", err)
+		return fallbackDummyHash
+	}
+	db.dummy.hasher, db.dummy.hash = db.Hasher, hash
+	return hash
+}
+
+// recordFailedLogin counts a wrong password of a user. When the count reaches LockoutThreshold, the account is
+// locked, the count starts over and the end of the lock is returned; otherwise the returned time is zero.
+// Unknown, inactive and locked users are left alone, so that it can be called on every rejected login.
+func (db *DBManager) recordFailedLogin(ctx context.Context, email string) (_ time.Time, err error) {
+	if db.LockoutThreshold <= 0 {
+		return time.Time{}, nil
+	}
+	ctx, end := db.startQuery(ctx, "DBManager.recordFailedLogin", "UPDATE")
+	defer end(&err)
+
+	now := time.Now().UTC()
+	until := now.Add(db.LockoutDuration)
+	var failed int
+	err = db.DB.QueryRowContext(ctx, `UPDATE users SET
+		failed_logins = CASE WHEN failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+		locked_until = CASE WHEN failed_logins + 1 >= $2 THEN $3 ELSE locked_until END
+		WHERE email = $1 AND status = $4 AND (locked_until IS NULL OR locked_until <= $5) RETURNING failed_logins`,
+		lookupEmail(email), db.LockoutThreshold, until, StatusActive, now).Scan(&failed)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil || failed > 0 {
+		return time.Time{}, err
+	}
+	db.Logger.WarnContext(ctx, "Locked account after too many failed logins", "email", lookupEmail(email), "until", until)
+	return until, nil
+}
+
+func (db *DBManager) resetFailedLogins(ctx context.Context, email string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.resetFailedLogins", "UPDATE")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `UPDATE users SET failed_logins = 0, locked_until = NULL WHERE email = $1;`, lookupEmail(email))
+	return err
+}
+
+// hashPassword hashes a new password with the configured Hasher in a slot of the HashLimiter. Callers hash before
+// starting their query, so that waiting for a slot and hashing do not count against QueryTimeout.
+func (db *DBManager) hashPassword(ctx context.Context, password string) (string, error) {
+	release, err := db.acquireHashSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return db.Hasher.Hash(password)
+}
+
+// rehashPassword replaces the verified hash old of a user's password by a new one. It does nothing if the password
+// has been changed in the meantime.
+func (db *DBManager) rehashPassword(ctx context.Context, email, old, password string) (err error) {
+	hash, err := db.hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	ctx, end := db.startQuery(ctx, "DBManager.rehashPassword", "UPDATE")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `UPDATE users SET password = $3 WHERE email = $1 AND password = $2;`, lookupEmail(email), old, hash)
+	if err == nil {
+		db.Logger.InfoContext(ctx, "Upgraded password hash", "email", lookupEmail(email))
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"iotdashboard/passwords"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestLoginTiming checks that rejecting an unknown email takes as long as rejecting a wrong password, with lockout
+// enabled so that failed logins are counted, by comparing the medians of interleaved samples. The database answers
+// after a delay, so that a query made for existing users only would show.
+func TestLoginTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test skipped in short mode")
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+	PSQL.Hasher = passwords.Bcrypt{Cost: 8}
+	hash, err := PSQL.Hasher.Hash("S3cure3Pa$$")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v \n", err)
+	}
+
+	const delay = 10 * time.Millisecond
+	query := regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")
+	columns := []string{"password", "status", "failed_logins", "locked_until"}
+	measure := func(email string, rows *sqlmock.Rows, want error) time.Duration {
+		mock.ExpectQuery(query).WillDelayFor(delay).WillReturnRows(rows)
+		failed := sqlmock.NewRows([]string{"failed_logins"})
+		if want == ErrBadPassword {
+			failed.AddRow(1)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET")).WillDelayFor(delay).WillReturnRows(failed)
+		start := time.Now()
+		err := PSQL.CheckUserCredentials(context.Background(), email, "wrongpass")
+		elapsed := time.Since(start)
+		if err != want {
+			t.Fatalf("Login of %s returned %v, want %v \n", email, err, want)
+		}
+		return elapsed
+	}
+	//the dummy hash is created on first use
+	measure("nobody@gmail.com", sqlmock.NewRows(columns), ErrUserNonexistant)
+
+	const samples = 25
+	var known, unknown []time.Duration
+	for i := 0; i < samples; i++ {
+		known = append(known, measure("user@gmail.com", sqlmock.NewRows(columns).AddRow(hash, StatusActive, 0, nil), ErrBadPassword))
+		unknown = append(unknown, measure("nobody@gmail.com", sqlmock.NewRows(columns), ErrUserNonexistant))
+	}
+	slices.Sort(known)
+	slices.Sort(unknown)
+	ratio := float64(unknown[samples/2]) / float64(known[samples/2])
+	if ratio < 0.75 || ratio > 1.33 {
+		t.Errorf("Median login time of unknown users is %v, of wrong passwords %v", unknown[samples/2], known[samples/2])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPasswordMatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	hash := "$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG"
+	cases := []struct {
+		password string
+		//nil for an unknown user
+		row   []driver.Value
+		match bool
+	}{
+		{"S3cure3Pa$$", []driver.Value{hash, StatusActive, 0, nil}, true},
+		//neither failed logins are counted nor is the hash upgraded
+		{"wrongpass", []driver.Value{hash, StatusActive, 4, nil}, false},
+		{"S3cure3Pa$$", []driver.Value{hash, StatusDisabled, 0, nil}, false},
+		{"S3cure3Pa$$", nil, false},
+	}
+
+	for i, c := range cases {
+		rows := sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"})
+		if c.row != nil {
+			rows.AddRow(c.row...)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+			WithArgs("user@gmail.com").WillReturnRows(rows)
+		match, err := PSQL.PasswordMatches(context.Background(), "user@gmail.com", c.password)
+		if err != nil || match != c.match {
+			t.Errorf("Case %d: password check returned %v, %v, want %v", i, match, err, c.match)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// busyLimiter has no free slots
+type busyLimiter struct{}
+
+var errNoSlot = errors.New("no slot")
+
+func (busyLimiter) Acquire(ctx context.Context) (func(), error) { return nil, errNoSlot }
+
+// TestCheckUserCredentialsBusy checks that every rejection fails alike when passwords cannot be verified,
+// so that unknown users are not rejected faster than known ones
+func TestCheckUserCredentialsBusy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+	PSQL.HashLimiter = busyLimiter{}
+
+	hash := "$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG"
+	locked := time.Now().UTC().Add(time.Minute)
+	for i, row := range [][]driver.Value{{hash, StatusActive, 0, nil}, {hash, StatusActive, 0, locked}, {hash, StatusDisabled, 0, nil}, nil} {
+		rows := sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"})
+		if row != nil {
+			rows.AddRow(row...)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).WillReturnRows(rows)
+		if err := PSQL.CheckUserCredentials(context.Background(), "user@gmail.com", "wrongpass"); err != errNoSlot {
+			t.Errorf("Case %d: credential validation returned %v, want %v", i, err, errNoSlot)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// failingHasher cannot hash passwords
+type failingHasher struct{ passwords.Bcrypt }
+
+func (failingHasher) Hash(password string) (string, error) { return "", errors.New("out of memory") }
+
+func TestDummyHashFallback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+	PSQL.Hasher = failingHasher{}
+
+	if hash := PSQL.dummyHash(); passwords.Verify(hash, "S3cure3Pa$$") != passwords.ErrMismatch {
+		t.Errorf("Dummy hash %q cannot be verified against", hash)
+	}
+	//unknown users are still rejected as unknown, after verifying a password
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET")).WillReturnRows(sqlmock.NewRows([]string{"failed_logins"}))
+	if err := PSQL.CheckUserCredentials(context.Background(), "nobody@gmail.com", "S3cure3Pa$$"); err != ErrUserNonexistant {
+		t.Errorf("Login of an unknown user returned %v, want %v", err, ErrUserNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
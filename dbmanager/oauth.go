@@ -0,0 +1,158 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrOAuthClientNonexistant = errors.New("OAuth client does not exist")
+var ErrAuthorizationCodeNonexistant = errors.New("Authorization code does not exist")
+
+// OAuthClient is a registered third-party integration. Confidential clients authenticate with a secret,
+// of which only the SHA-256 hash is stored; public clients rely on PKCE alone.
+type OAuthClient struct {
+	ID           int      `json:"-"`
+	ClientID     string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	// Role is granted to tokens the client obtains for itself with the client credentials grant
+	Role         string    `json:"role"`
+	Confidential bool      `json:"confidential"`
+	Created      time.Time `json:"created"`
+}
+
+// AuthorizationCode is a pending authorization code grant, stored under the SHA-256 hash of the code
+type AuthorizationCode struct {
+	ClientID      string
+	Email         string
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	Expires       time.Time
+}
+
+//AddOAuthClient registers a client. An empty secretHash registers a public client.
+func (db *DBManager) AddOAuthClient(ctx context.Context, c OAuthClient, secretHash string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.AddOAuthClient", "INSERT")
+	defer end(&err)
+
+	secret := sql.NullString{String: secretHash, Valid: secretHash != ""}
+	_, err = db.DB.ExecContext(ctx,
+		`INSERT INTO oauth_clients(client_id,name,secret_hash,redirect_uris,scopes,role) VALUES ($1 , $2 , $3 , $4 , $5 , $6);`,
+		c.ClientID, c.Name, secret, strings.Join(c.RedirectURIs, " "), strings.Join(c.Scopes, " "), c.Role)
+	return err
+}
+
+//GetOAuthClient returns a client and its secret hash, which is empty for public clients
+func (db *DBManager) GetOAuthClient(ctx context.Context, clientID string) (_ OAuthClient, _ string, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetOAuthClient", "SELECT")
+	defer end(&err)
+
+	row := db.DB.QueryRowContext(ctx, `SELECT id, client_id, name, secret_hash, redirect_uris, scopes, role, created
+		FROM oauth_clients WHERE client_id = $1`, clientID)
+	c, secret, err := scanOAuthClient(row)
+	if err == sql.ErrNoRows {
+		return OAuthClient{}, "", ErrOAuthClientNonexistant
+	}
+	return c, secret, err
+}
+
+//ListOAuthClients returns every registered client, oldest first
+func (db *DBManager) ListOAuthClients(ctx context.Context) (_ []OAuthClient, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.ListOAuthClients", "SELECT")
+	defer end(&err)
+
+	rows, err := db.DB.QueryContext(ctx, `SELECT id, client_id, name, secret_hash, redirect_uris, scopes, role, created
+		FROM oauth_clients ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		c, _, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func scanOAuthClient(row rowScanner) (OAuthClient, string, error) {
+	var c OAuthClient
+	var secret sql.NullString
+	var redirectURIs, scopes string
+	err := row.Scan(&c.ID, &c.ClientID, &c.Name, &secret, &redirectURIs, &scopes, &c.Role, &c.Created)
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	c.Scopes = strings.Fields(scopes)
+	c.Confidential = secret.Valid
+	return c, secret.String, nil
+}
+
+//AddAuthorizationCode stores a code until it is redeemed or expires. Expired codes are cleaned up on the way.
+func (db *DBManager) AddAuthorizationCode(ctx context.Context, code AuthorizationCode, hash string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.AddAuthorizationCode", "INSERT")
+	defer end(&err)
+
+	if _, err := db.DB.ExecContext(ctx, `DELETE FROM oauth_codes WHERE expires < current_timestamp;`); err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx,
+		`INSERT INTO oauth_codes(hash,client_id,email,redirect_uri,scopes,code_challenge,expires) VALUES ($1 , $2 , $3 , $4 , $5 , $6 , $7);`,
+		hash, code.ClientID, code.Email, code.RedirectURI, strings.Join(code.Scopes, " "), code.CodeChallenge, code.Expires)
+	return err
+}
+
+//ConsumeAuthorizationCode deletes and returns the code with the given hash, so that each code can only be redeemed once
+func (db *DBManager) ConsumeAuthorizationCode(ctx context.Context, hash string) (_ AuthorizationCode, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.ConsumeAuthorizationCode", "DELETE")
+	defer end(&err)
+
+	row := db.DB.QueryRowContext(ctx, `DELETE FROM oauth_codes WHERE hash = $1
+		RETURNING client_id, email, redirect_uri, scopes, code_challenge, expires`, hash)
+	var code AuthorizationCode
+	var scopes string
+	err = row.Scan(&code.ClientID, &code.Email, &code.RedirectURI, &scopes, &code.CodeChallenge, &code.Expires)
+	if err == sql.ErrNoRows {
+		return AuthorizationCode{}, ErrAuthorizationCodeNonexistant
+	}
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	code.Scopes = strings.Fields(scopes)
+	return code, nil
+}
+
+func (db *DBManager) initSchemaOAuth(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS oauth_clients(
+			 id serial PRIMARY KEY,
+			 client_id VARCHAR (64) UNIQUE NOT NULL,
+			 name VARCHAR (128) NOT NULL,
+			 secret_hash CHAR (64),
+			 redirect_uris TEXT NOT NULL,
+			 scopes TEXT NOT NULL,
+			 role VARCHAR (32) NOT NULL DEFAULT 'user',
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 );
+		CREATE TABLE IF NOT EXISTS oauth_codes(
+			 hash CHAR (64) PRIMARY KEY,
+			 client_id VARCHAR (64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+			 email VARCHAR (254) NOT NULL REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+			 redirect_uri TEXT NOT NULL,
+			 scopes TEXT NOT NULL,
+			 code_challenge VARCHAR (128) NOT NULL,
+			 expires TIMESTAMP NOT NULL
+			 );`,
+	)
+	return err
+}
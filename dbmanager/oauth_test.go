@@ -0,0 +1,82 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetOAuthClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	columns := []string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}
+	cases := []struct {
+		clientID     string
+		secretHash   interface{}
+		confidential bool
+		err          error
+	}{
+		{"grafana", "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", true, nil},
+		{"cli", nil, false, nil},
+		{"unknown", nil, false, ErrOAuthClientNonexistant},
+	}
+	for _, c := range cases {
+		rows := sqlmock.NewRows(columns)
+		if c.err == nil {
+			rows.AddRow(1, c.clientID, c.clientID, c.secretHash, "https://a.example.com/cb https://b.example.com/cb", "audit:read", "user", time.Now())
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).WithArgs(c.clientID).WillReturnRows(rows)
+
+		client, secret, err := PSQL.GetOAuthClient(context.Background(), c.clientID)
+		if err != c.err {
+			t.Errorf("GetOAuthClient(%s) returned %v, want %v", c.clientID, err, c.err)
+			continue
+		}
+		if err == nil && (client.Confidential != c.confidential || (secret != "") != c.confidential || len(client.RedirectURIs) != 2) {
+			t.Errorf("Unexpected client %+v with secret hash %q", client, secret)
+		}
+	}
+}
+
+func TestConsumeAuthorizationCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("DELETE FROM oauth_codes WHERE hash = $1")
+	columns := []string{"client_id", "email", "redirect_uri", "scopes", "code_challenge", "expires"}
+	mock.ExpectQuery(query).WithArgs("h1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("cli", "user@gmail.com", "https://a.example.com/cb", "audit:read keys:read", "challenge", time.Now()))
+	mock.ExpectQuery(query).WithArgs("h1").WillReturnRows(sqlmock.NewRows(columns))
+
+	code, err := PSQL.ConsumeAuthorizationCode(context.Background(), "h1")
+	if err != nil || code.ClientID != "cli" || len(code.Scopes) != 2 {
+		t.Errorf("Unexpected code %+v: %v", code, err)
+	}
+	if _, err := PSQL.ConsumeAuthorizationCode(context.Background(), "h1"); err != ErrAuthorizationCodeNonexistant {
+		t.Errorf("Expected ErrAuthorizationCodeNonexistant for a consumed code, got: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrPrincipalNonexistant = errors.New("Service principal does not exist")
+
+// ServicePrincipal is a device or backend service that authenticates with a client certificate.
+// Identity is matched against the certificate's SAN URIs, DNS names, email addresses or subject common name.
+type ServicePrincipal struct {
+	ID       int
+	Name     string
+	Identity string
+	Role     string
+	Created  time.Time
+}
+
+//AddServicePrincipal registers a certificate identity under the given name and role
+func (db *DBManager) AddServicePrincipal(ctx context.Context, name, identity, role string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.AddServicePrincipal", "INSERT")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO service_principals(name,identity,role) VALUES ($1 , $2 , $3);`, name, identity, role)
+	return err
+}
+
+//GetServicePrincipal returns the principal registered for a certificate identity, or ErrPrincipalNonexistant
+func (db *DBManager) GetServicePrincipal(ctx context.Context, identity string) (_ ServicePrincipal, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetServicePrincipal", "SELECT")
+	defer end(&err)
+
+	result := db.DB.QueryRowContext(ctx, `SELECT id, name, identity, role, created from service_principals WHERE identity = $1`, identity)
+
+	var p ServicePrincipal
+	if err := result.Scan(&p.ID, &p.Name, &p.Identity, &p.Role, &p.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return ServicePrincipal{}, ErrPrincipalNonexistant
+		}
+		return ServicePrincipal{}, err
+	}
+	return p, nil
+}
+
+func (db *DBManager) initSchemaServicePrincipals(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS service_principals(
+			 id serial PRIMARY KEY,
+			 name VARCHAR (128) UNIQUE NOT NULL,
+			 identity VARCHAR (512) UNIQUE NOT NULL,
+			 role VARCHAR (32) NOT NULL DEFAULT 'user',
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 )`,
+	)
+	return err
+}
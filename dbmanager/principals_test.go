@@ -0,0 +1,40 @@
+package dbmanager
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetServicePrincipal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("SELECT id, name, identity, role, created from service_principals WHERE identity = $1")
+	mock.ExpectQuery(query).WithArgs("spiffe://iot/gateway-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "identity", "role", "created"}).
+			AddRow(1, "gateway-1", "spiffe://iot/gateway-1", "user", time.Now()))
+	mock.ExpectQuery(query).WithArgs("unknown").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "identity", "role", "created"}))
+
+	p, err := PSQL.GetServicePrincipal(context.Background(), "spiffe://iot/gateway-1")
+	if err != nil || p.Name != "gateway-1" {
+		t.Errorf("Unexpected principal %+v: %v", p, err)
+	}
+	if _, err := PSQL.GetServicePrincipal(context.Background(), "unknown"); err != ErrPrincipalNonexistant {
+		t.Errorf("Expected ErrPrincipalNonexistant, got: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrRegistrationNonexistant = errors.New("Registration does not exist")
+
+// Registration is a self-registration waiting for an admin's approval
+type Registration struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+}
+
+//AddRegistration queues a registration for approval. Registering an email that is already queued does nothing.
+func (db *DBManager) AddRegistration(ctx context.Context, reg Registration) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.AddRegistration", "INSERT")
+	defer end(&err)
+
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO registrations(email,ip,user_agent) VALUES ($1 , $2 , $3) ON CONFLICT (email) DO NOTHING;`,
+		reg.Email, reg.IP, reg.UserAgent)
+	return err
+}
+
+//ListRegistrations returns the registrations waiting for approval, oldest first
+func (db *DBManager) ListRegistrations(ctx context.Context) (_ []Registration, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.ListRegistrations", "SELECT")
+	defer end(&err)
+
+	rows, err := db.DB.QueryContext(ctx, `SELECT id, email, ip, user_agent, created FROM registrations ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	registrations := []Registration{}
+	for rows.Next() {
+		var reg Registration
+		if err := rows.Scan(&reg.ID, &reg.Email, &reg.IP, &reg.UserAgent, &reg.Created); err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, reg)
+	}
+	return registrations, rows.Err()
+}
+
+//GetRegistration returns the queued registration with the given ID, or ErrRegistrationNonexistant
+func (db *DBManager) GetRegistration(ctx context.Context, id int) (_ Registration, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.GetRegistration", "SELECT")
+	defer end(&err)
+
+	var reg Registration
+	err = db.DB.QueryRowContext(ctx, `SELECT id, email, ip, user_agent, created FROM registrations WHERE id = $1`, id).
+		Scan(&reg.ID, &reg.Email, &reg.IP, &reg.UserAgent, &reg.Created)
+	if err == sql.ErrNoRows {
+		return Registration{}, ErrRegistrationNonexistant
+	}
+	return reg, err
+}
+
+//DeleteRegistration removes a registration from the queue once it has been approved or rejected
+func (db *DBManager) DeleteRegistration(ctx context.Context, id int) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.DeleteRegistration", "DELETE")
+	defer end(&err)
+
+	result, err := db.DB.ExecContext(ctx, `DELETE FROM registrations WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrRegistrationNonexistant
+	}
+	return nil
+}
+
+func (db *DBManager) initSchemaRegistrations(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS registrations(
+			 id serial PRIMARY KEY,
+			 email VARCHAR (254) UNIQUE NOT NULL,
+			 ip VARCHAR (45) NOT NULL,
+			 user_agent TEXT NOT NULL,
+			 created TIMESTAMP NOT NULL default current_timestamp
+			 )`,
+	)
+	return err
+}
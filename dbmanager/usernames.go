@@ -0,0 +1,101 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrInvalidUsername  = errors.New("Invalid username")
+	ErrReservedUsername = errors.New("Username is reserved")
+	ErrUsernameTaken    = errors.New("Username is taken")
+)
+
+// Length limits of usernames, after normalization
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+)
+
+// usernamePattern allows lower case ASCII letters and digits, separated by single dots, dashes or underscores.
+// Without an @ a username can never be mistaken for an email address.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+// reservedUsernames could be mistaken for the system or its staff. They are compared without separators,
+// so that e.g. "no-reply" and "ad.min" are reserved as well.
+var reservedUsernames = map[string]bool{
+	"abuse": true, "admin": true, "administrator": true, "anonymous": true, "api": true, "bootstrap": true,
+	"guest": true, "hostmaster": true, "iotdashboard": true, "login": true, "logout": true, "me": true,
+	"noreply": true, "null": true, "operator": true, "postmaster": true, "register": true, "root": true,
+	"security": true, "setup": true, "support": true, "system": true, "undefined": true, "webmaster": true,
+}
+
+// uniqueViolation is the Postgres error code of a unique constraint violation
+const uniqueViolation = "23505"
+
+//NormalizeUsername validates a username and returns its canonical form: compatibility characters such as
+//full-width letters are folded to ASCII and upper case is lowered, so that usernames which look alike are the same.
+//It returns ErrInvalidUsername for names that do not fit the pattern and ErrReservedUsername for reserved names.
+func NormalizeUsername(username string) (string, error) {
+	normalized := strings.ToLower(norm.NFKC.String(strings.TrimSpace(username)))
+	if len(normalized) < MinUsernameLength || len(normalized) > MaxUsernameLength {
+		return "", fmt.Errorf("%w %q: must be %d to %d characters", ErrInvalidUsername, username, MinUsernameLength, MaxUsernameLength)
+	}
+	if !usernamePattern.MatchString(normalized) {
+		return "", fmt.Errorf("%w %q: only letters and digits separated by single dots, dashes or underscores are allowed",
+			ErrInvalidUsername, username)
+	}
+	if reservedUsernames[strings.NewReplacer(".", "", "-", "", "_", "").Replace(normalized)] {
+		return "", fmt.Errorf("%w: %q", ErrReservedUsername, username)
+	}
+	return normalized, nil
+}
+
+//SetUsername sets the username a user can log in with instead of their email, or removes it if username is empty.
+//It returns ErrUsernameTaken if another user has the username.
+func (db *DBManager) SetUsername(ctx context.Context, email, username string) (err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.SetUsername", "UPDATE")
+	defer end(&err)
+
+	var value sql.NullString
+	if username != "" {
+		if value.String, err = NormalizeUsername(username); err != nil {
+			return err
+		}
+		value.Valid = true
+	}
+	result, err := db.DB.ExecContext(ctx, `UPDATE users SET username = $2 WHERE email = $1;`, lookupEmail(email), value)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+//EmailForUsername returns the email of the user with the given username, or ErrUserNonexistant if there is none
+func (db *DBManager) EmailForUsername(ctx context.Context, username string) (_ string, err error) {
+	ctx, end := db.startQuery(ctx, "DBManager.EmailForUsername", "SELECT")
+	defer end(&err)
+
+	username, err = NormalizeUsername(username)
+	if err != nil {
+		// no user can have an invalid username
+		return "", ErrUserNonexistant
+	}
+	var email string
+	err = db.DB.QueryRowContext(ctx, `SELECT email from users WHERE username = $1`, username).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNonexistant
+	}
+	return email, err
+}
@@ -0,0 +1,122 @@
+package dbmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	cases := []struct {
+		username, want string
+		err            error
+	}{
+		{"tech1", "tech1", nil},
+		{" Field.Tech_2 ", "field.tech_2", nil},
+		{"j-doe", "j-doe", nil},
+		//full-width letters look the same as ASCII ones
+		{"ｔｅｃｈ１", "tech1", nil},
+		{"ab", "", ErrInvalidUsername},
+		{"a23456789012345678901234567890123", "", ErrInvalidUsername},
+		{"tech@site", "", ErrInvalidUsername},
+		{"tech one", "", ErrInvalidUsername},
+		{".tech", "", ErrInvalidUsername},
+		{"tech..one", "", ErrInvalidUsername},
+		{"tech-", "", ErrInvalidUsername},
+		{"jürgen", "", ErrInvalidUsername},
+		{"admin", "", ErrReservedUsername},
+		{"Root", "", ErrReservedUsername},
+		{"no-reply", "", ErrReservedUsername},
+		{"ad.min", "", ErrReservedUsername},
+	}
+
+	for _, c := range cases {
+		got, err := NormalizeUsername(c.username)
+		if !errors.Is(err, c.err) || got != c.want {
+			t.Errorf("NormalizeUsername(%q) returned %q, %v, want %q, %v", c.username, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestSetUsername(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("UPDATE users SET username = $2 WHERE email = $1;")
+	mock.ExpectExec(query).WithArgs("user@gmail.com", sql.NullString{String: "tech1", Valid: true}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := PSQL.SetUsername(context.Background(), "User@gmail.com", "Tech1"); err != nil {
+		t.Errorf("Setting a username failed: %v", err)
+	}
+
+	mock.ExpectExec(query).WithArgs("user@gmail.com", sql.NullString{}).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := PSQL.SetUsername(context.Background(), "user@gmail.com", ""); err != nil {
+		t.Errorf("Removing a username failed: %v", err)
+	}
+
+	mock.ExpectExec(query).WillReturnError(&pq.Error{Code: "23505"})
+	if err := PSQL.SetUsername(context.Background(), "other@gmail.com", "tech1"); err != ErrUsernameTaken {
+		t.Errorf("Setting a taken username returned %v, want %v", err, ErrUsernameTaken)
+	}
+
+	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := PSQL.SetUsername(context.Background(), "nobody@gmail.com", "tech2"); err != ErrUserNonexistant {
+		t.Errorf("Setting the username of an unknown user returned %v, want %v", err, ErrUserNonexistant)
+	}
+
+	if err := PSQL.SetUsername(context.Background(), "user@gmail.com", "admin"); !errors.Is(err, ErrReservedUsername) {
+		t.Errorf("Setting a reserved username returned %v, want %v", err, ErrReservedUsername)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEmailForUsername(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	PSQL, err := New("postgres", "myPassword", "iot_dashboard", testLogger)
+	if err != nil {
+		t.Fatalf("Unable to initialize DB Manager: %v \n", err)
+	}
+	//overwrite db connection with mock
+	PSQL.DB = db
+
+	query := regexp.QuoteMeta("SELECT email from users WHERE username = $1")
+	mock.ExpectQuery(query).WithArgs("tech1").WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	if email, err := PSQL.EmailForUsername(context.Background(), "TECH1"); err != nil || email != "user@gmail.com" {
+		t.Errorf("Looking up a username returned %q, %v", email, err)
+	}
+
+	mock.ExpectQuery(query).WithArgs("tech2").WillReturnRows(sqlmock.NewRows([]string{"email"}))
+	if _, err := PSQL.EmailForUsername(context.Background(), "tech2"); err != ErrUserNonexistant {
+		t.Errorf("Looking up an unknown username returned %v, want %v", err, ErrUserNonexistant)
+	}
+
+	//invalid names are not looked up
+	if _, err := PSQL.EmailForUsername(context.Background(), "x"); err != ErrUserNonexistant {
+		t.Errorf("Looking up an invalid username returned %v, want %v", err, ErrUserNonexistant)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
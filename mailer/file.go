@@ -0,0 +1,36 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileSender writes every message to its own .eml file in Dir instead of sending it, for development and tests
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+// Send writes msg to a new file in Dir, which is created if necessary
+func (s *FileSender) Send(ctx context.Context, msg Message) error {
+	data, err := encode(s.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	recipient := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, msg.To)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), recipient)
+	// the files contain single-use links, so keep them private
+	return os.WriteFile(filepath.Join(s.Dir, name), data, 0600)
+}
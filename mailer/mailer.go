@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages, e.g. over SMTP
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Config selects and configures a Sender
+type Config struct {
+	// Kind is "smtp", "file" (written to Dir) or "" / "none" to disable sending
+	Kind string
+	// From is the sender address of every message
+	From string
+	// Dir receives one .eml file per message when Kind is "file"
+	Dir string
+	// SMTPAddr is the host:port of the mail server. STARTTLS is used when the server offers it.
+	SMTPAddr string
+	// SMTPUser and SMTPPassword authenticate with PLAIN when SMTPUser is set
+	SMTPUser     string
+	SMTPPassword string
+}
+
+// ErrDisabled is returned by the Sender of Kind "none"
+var ErrDisabled = errors.New("Sending mail is disabled")
+
+// New returns the Sender described by cfg
+func New(cfg Config) (Sender, error) {
+	if cfg.Kind == "" || cfg.Kind == "none" {
+		return disabled{}, nil
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("Invalid sender address %q: %v", cfg.From, err)
+	}
+	switch cfg.Kind {
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, errors.New("No SMTP server configured")
+		}
+		return &SMTPSender{Addr: cfg.SMTPAddr, Username: cfg.SMTPUser, Password: cfg.SMTPPassword, From: cfg.From}, nil
+	case "file":
+		return &FileSender{Dir: cfg.Dir, From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("Unknown mail sender %q", cfg.Kind)
+	}
+}
+
+type disabled struct{}
+
+func (disabled) Send(context.Context, Message) error { return ErrDisabled }
+
+// encode renders msg as an RFC 5322 message from the given address, with a quoted-printable UTF-8 body
+func encode(from string, msg Message) ([]byte, error) {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid recipient %q: %v", msg.To, err)
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("Subject must not contain line breaks")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok {
+		domain = strings.TrimSuffix(d, ">")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
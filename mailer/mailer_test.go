@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		cfg     Config
+		success bool
+	}{
+		{Config{}, true},
+		{Config{Kind: "file", From: "IoT Dashboard <noreply@example.com>", Dir: "mail"}, true},
+		{Config{Kind: "smtp", From: "noreply@example.com", SMTPAddr: "mail.example.com:587"}, true},
+		{Config{Kind: "smtp", From: "noreply@example.com"}, false},
+		{Config{Kind: "file", From: "not an address"}, false},
+		{Config{Kind: "carrier-pigeon", From: "noreply@example.com"}, false},
+	}
+	for _, c := range cases {
+		if _, err := New(c.cfg); (err == nil) != c.success {
+			t.Errorf("New(%+v) returned %v", c.cfg, err)
+		}
+	}
+
+	sender, _ := New(Config{Kind: "none"})
+	if err := sender.Send(context.Background(), Message{To: "user@gmail.com"}); err != ErrDisabled {
+		t.Errorf("Disabled sender returned %v, want %v", err, ErrDisabled)
+	}
+}
+
+func TestFileSender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	sender := &FileSender{Dir: dir, From: "IoT Dashboard <noreply@example.com>"}
+
+	msg := Message{To: "user@gmail.com", Subject: "Willkommen im Dashboard", Body: "Grüße\nhttps://example.com/invite?token=abc"}
+	if err := sender.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Sending failed: %v \n", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0].Name(), "-user@gmail.com.eml") {
+		t.Fatalf("Unexpected files %v: %v \n", files, err)
+	}
+	f, err := os.Open(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("Failed to open message: %v \n", err)
+	}
+	defer f.Close()
+	parsed, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("Message cannot be parsed: %v \n", err)
+	}
+	if parsed.Header.Get("To") != "<user@gmail.com>" || parsed.Header.Get("Subject") != msg.Subject {
+		t.Errorf("Unexpected headers %v", parsed.Header)
+	}
+
+	for _, bad := range []Message{{To: "not an address"}, {To: "user@gmail.com", Subject: "Hi\r\nBcc: victim@gmail.com"}} {
+		if err := sender.Send(context.Background(), bad); err == nil {
+			t.Errorf("Message %+v was sent", bad)
+		}
+	}
+}
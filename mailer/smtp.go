@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPSender delivers messages through a mail server
+type SMTPSender struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers msg to the mail server, upgrading the connection with STARTTLS when the server offers it.
+// Credentials are only sent over TLS or to localhost, as enforced by smtp.PlainAuth.
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	data, err := encode(s.From, msg)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// smtp.SendMail cannot be cancelled, so give up waiting for it once ctx is done
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.Addr, auth, from.Address, []string{to.Address}, data) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,23 +1,136 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"iotdashboard/cli"
+	"iotdashboard/config"
+	"iotdashboard/controller"
+	"iotdashboard/metrics"
 	"iotdashboard/router"
-	"log"
+	"iotdashboard/tracing"
+	"iotdashboard/utils"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	router, err := router.NewRouter(":8080", ":9090", "server-cert.pem", "server-key.pem")
+	cfg, err := config.FromEnv()
+	logger := utils.NewLogger(os.Stdout, cfg.LogFormat, utils.ParseLogLevel(cfg.LogLevel))
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("Invalid configuration", "error", err)
+		os.Exit(1)
 	}
 
-	err = router.Ctrlr.PSQL.AddNewUser("e@g.c", "test")
+	args := os.Args[1:]
+	switch {
+	case len(args) == 0 || args[0] == "serve":
+		os.Exit(serve(cfg, logger))
+	case args[0] == "help" || args[0] == "-h" || args[0] == "--help":
+		fmt.Print(cli.Usage)
+	default:
+		os.Exit(runCommand(cfg, args))
+	}
+}
+
+// runCommand runs an administrative subcommand, logging to stderr so that stdout only carries the command's output
+func runCommand(cfg config.Config, args []string) int {
+	logger := utils.NewLogger(os.Stderr, cfg.LogFormat, max(utils.ParseLogLevel(cfg.LogLevel), slog.LevelWarn))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts, err := cfg.Database()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctrlr, err := controller.NewController(opts, logger, metrics.New())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open the database:", err)
+		return 1
+	}
+	defer ctrlr.Close()
+	ctrlr.DeletedRetention = cfg.DeletedRetention
+	if ctrlr.Invites, err = cfg.Invites(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid mail configuration:", err)
+		return 1
+	}
+
+	app := &cli.App{Ctrlr: ctrlr, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+	err = app.Run(ctx, args)
+	if errors.Is(err, cli.ErrUsage) {
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, cli.Usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// serve runs the web server until it fails or a shutdown signal arrives, returning the exit code
+func serve(cfg config.Config, logger *slog.Logger) int {
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TraceExporter, cfg.TraceFile)
 	if err != nil {
-		log.Printf("Not able to add new user: %v", err)
+		logger.Error("Failed to set up tracing", "error", err)
+		return 1
 	}
 
-	err = router.Start()
+	router, err := router.NewRouter(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to initialize router", "error", err)
+		return 1
+	}
+
+	setupToken, err := router.Ctrlr.Bootstrap(context.Background(), cfg.BootstrapAdminEmail, cfg.BootstrapAdminPassword,
+		controller.ClientInfo{UserAgent: "bootstrap"})
+	if err != nil {
+		logger.Error("Failed to bootstrap the initial admin", "error", err)
+		return 1
+	}
+	if setupToken != "" {
+		logger.Warn("No users exist yet. Create the first admin by posting this one-time token to /setup", "setup_token", setupToken)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- router.Start() }()
+
+	// SIGHUP reloads the TLS certificates without dropping connections
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := router.ReloadCertificates(); err != nil {
+				logger.Error("Failed to reload TLS certificates", "error", err)
+			}
+		}
+	}()
+
+	select {
+	case err = <-serveErr:
+		logger.Error("Server stopped", "error", err)
+	case <-ctx.Done():
+		logger.Info("Received shutdown signal")
+		stop()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := router.Shutdown(shutdownCtx); shutdownErr != nil {
+		logger.Error("Shutdown was not clean", "error", shutdownErr)
+	}
+	if shutdownErr := shutdownTracing(shutdownCtx); shutdownErr != nil {
+		logger.Error("Failed to flush traces", "error", shutdownErr)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "iotdash"
+
+// Metrics holds the Prometheus collectors shared by the router and controller
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	// HTTPRequests counts handled requests by route, method and status code
+	HTTPRequests *prometheus.CounterVec
+	// HTTPDuration observes request latency by route and method
+	HTTPDuration *prometheus.HistogramVec
+	// Logins counts login attempts by result ("success", "failure", "error" when the database did not answer
+	// or "busy" when too many passwords were being checked)
+	Logins *prometheus.CounterVec
+	// PasswordCheckDuration observes the time spent verifying a password, which is dominated by the password hash
+	PasswordCheckDuration prometheus.Histogram
+	// PasswordHashWait observes how long password hashing waited for a free slot
+	PasswordHashWait prometheus.Histogram
+	// PasswordHashQueue is the number of password hashing operations waiting for a slot
+	PasswordHashQueue prometheus.Gauge
+	// PasswordHashRejected counts password hashing operations refused because the queue was full
+	PasswordHashRejected prometheus.Counter
+}
+
+// New creates a registry with the process and Go runtime collectors plus the dashboard's own metrics
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		HTTPRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		HTTPDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		Logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Number of login attempts, by result.",
+		}, []string{"result"}),
+		PasswordCheckDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "password_check_duration_seconds",
+			Help:      "Time spent looking up and verifying a password hash.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+		}),
+		PasswordHashWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "password_hash_wait_seconds",
+			Help:      "Time password hashing and verification waited for a free slot.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+		}),
+		PasswordHashQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "password_hash_queue_length",
+			Help:      "Number of password hashing and verification operations waiting for a free slot.",
+		}),
+		PasswordHashRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "password_hash_rejected_total",
+			Help:      "Number of password hashing and verification operations refused because the queue was full.",
+		}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		m.HTTPRequests,
+		m.HTTPDuration,
+		m.Logins,
+		m.PasswordCheckDuration,
+		m.PasswordHashWait,
+		m.PasswordHashQueue,
+		m.PasswordHashRejected,
+	)
+	return m
+}
+
+// RegisterGaugeFunc exposes a gauge whose value is read from f at scrape time
+func (m *Metrics) RegisterGaugeFunc(name, help string, f func() float64) {
+	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+// RegisterDBStats exposes the connection pool statistics of db
+func (m *Metrics) RegisterDBStats(db *sql.DB, dbName string) {
+	m.Registry.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
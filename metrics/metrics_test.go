@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.HTTPRequests.WithLabelValues("/login", "POST", "200").Inc()
+	m.Logins.WithLabelValues("failure").Inc()
+	m.PasswordCheckDuration.Observe(0.08)
+	m.RegisterGaugeFunc("blocklist_size", "Number of blocklisted tokens.", func() float64 { return 3 })
+	m.RegisterDBStats(&sql.DB{}, "iot_dashboard")
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request %v \n", err)
+	}
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, req)
+	body, _ := io.ReadAll(rr.Body)
+
+	expected := []string{
+		`iotdash_http_requests_total{method="POST",route="/login",status="200"} 1`,
+		`iotdash_logins_total{result="failure"} 1`,
+		`iotdash_password_check_duration_seconds_count 1`,
+		`iotdash_blocklist_size 3`,
+		`go_sql_open_connections{db_name="iot_dashboard"}`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("Metrics output is missing %q", e)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// Lengths of the salt and the derived key of new Argon2id hashes, in bytes
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var errMalformedArgon2id = errors.New("Malformed argon2id hash")
+
+// Argon2id hashes passwords with Argon2id, using Memory KiB of memory, Time passes and Threads lanes
+type Argon2id struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultArgon2id returns the parameters recommended by RFC 9106 for memory-constrained environments,
+// with fewer lanes so that concurrent logins do not occupy every core
+func DefaultArgon2id() Argon2id {
+	return Argon2id{Memory: 64 * 1024, Time: 3, Threads: 2}
+}
+
+func (h Argon2id) validate() error {
+	if h.Time < 1 || h.Threads < 1 {
+		return errors.New("argon2id time and threads must be at least 1")
+	}
+	if h.Memory < 8*uint32(h.Threads) {
+		return fmt.Errorf("argon2id memory must be at least %d KiB for %d threads", 8*uint32(h.Threads), h.Threads)
+	}
+	return nil
+}
+
+// Hash returns the PHC string of the Argon2id hash of password
+func (h Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2KeyLength)
+	return h.encode(salt, key), nil
+}
+
+func (h Argon2id) encode(salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// NeedsRehash reports whether encoded is not an Argon2id hash with the parameters of h
+func (h Argon2id) NeedsRehash(encoded string) bool {
+	params, _, key, err := decodeArgon2id(encoded)
+	return err != nil || params != h || len(key) != argon2KeyLength
+}
+
+// decodeArgon2id parses a PHC string of the form $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func decodeArgon2id(encoded string) (h Argon2id, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return h, nil, nil, errMalformedArgon2id
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, nil, nil, fmt.Errorf("%w: unsupported version %q", errMalformedArgon2id, parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.Memory, &h.Time, &h.Threads); err != nil {
+		return h, nil, nil, fmt.Errorf("%w: %v", errMalformedArgon2id, err)
+	}
+	if err := h.validate(); err != nil {
+		return h, nil, nil, fmt.Errorf("%w: %v", errMalformedArgon2id, err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, nil, nil, fmt.Errorf("%w: %v", errMalformedArgon2id, err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return h, nil, nil, fmt.Errorf("%w: invalid key", errMalformedArgon2id)
+	}
+	return h, salt, key, nil
+}
+
+func verifyArgon2id(encoded, password string) error {
+	h, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+	derived := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package passwords
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultBcryptCost is the cost the dashboard has always hashed passwords with
+const DefaultBcryptCost = 10
+
+// Bcrypt hashes passwords with bcrypt at Cost. Passwords longer than 72 bytes are rejected by bcrypt.
+type Bcrypt struct {
+	Cost int
+}
+
+func (h Bcrypt) validate() error {
+	if h.Cost < bcrypt.MinCost || h.Cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+// Hash returns the bcrypt hash of password
+func (h Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+// NeedsRehash reports whether encoded is not a bcrypt hash of cost h.Cost
+func (h Bcrypt) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func verifyBcrypt(encoded, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+// Package passwords hashes and verifies user passwords with bcrypt or Argon2id.
+//
+// Hashes are self-describing strings: bcrypt's own "$2a$10$..." format and the PHC string format for Argon2id,
+// e.g. "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>". Verify accepts either, so the configured algorithm and its
+// parameters can change at any time; NeedsRehash tells which stored hashes to replace at the next login.
+package passwords
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrMismatch is returned by Verify when the password does not match the hash
+	ErrMismatch = errors.New("Password does not match")
+	// ErrUnknownAlgorithm is returned for hashes in a format no hasher understands
+	ErrUnknownAlgorithm = errors.New("Unknown password hash algorithm")
+)
+
+// Algorithms that can be configured
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// Hasher hashes new passwords with an algorithm and parameters of its choosing
+type Hasher interface {
+	// Hash returns the encoded hash of password with a random salt
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether encoded was produced by another algorithm or with other parameters than the
+	// hasher would use now, so that it should be replaced by a new hash once the password is known
+	NeedsRehash(encoded string) bool
+}
+
+// Config selects the hasher of new passwords and its parameters. Zero parameters take the defaults.
+type Config struct {
+	// Algorithm is "bcrypt" or "argon2id"
+	Algorithm  string
+	BcryptCost int
+	// Argon2Memory is in KiB
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+}
+
+// New returns the hasher described by cfg
+func New(cfg Config) (Hasher, error) {
+	switch cfg.Algorithm {
+	case AlgorithmBcrypt, "":
+		h := Bcrypt{Cost: cfg.BcryptCost}
+		if h.Cost == 0 {
+			h.Cost = DefaultBcryptCost
+		}
+		return h, h.validate()
+	case AlgorithmArgon2id:
+		h := DefaultArgon2id()
+		if cfg.Argon2Memory != 0 {
+			h.Memory = cfg.Argon2Memory
+		}
+		if cfg.Argon2Time != 0 {
+			h.Time = cfg.Argon2Time
+		}
+		if cfg.Argon2Threads != 0 {
+			h.Threads = cfg.Argon2Threads
+		}
+		return h, h.validate()
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownAlgorithm, cfg.Algorithm)
+}
+
+// Verify checks password against encoded, using whichever supported algorithm produced it.
+// It returns ErrMismatch if the password is wrong.
+func Verify(encoded, password string) error {
+	switch {
+	case isBcrypt(encoded):
+		return verifyBcrypt(encoded, password)
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return verifyArgon2id(encoded, password)
+	}
+	return ErrUnknownAlgorithm
+}
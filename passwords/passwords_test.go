@@ -0,0 +1,114 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// cheap parameters keep the tests fast
+var testArgon2id = Argon2id{Memory: 64, Time: 1, Threads: 1}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		cfg  Config
+		want Hasher
+		ok   bool
+	}{
+		{Config{}, Bcrypt{Cost: DefaultBcryptCost}, true},
+		{Config{Algorithm: "bcrypt", BcryptCost: 12}, Bcrypt{Cost: 12}, true},
+		{Config{Algorithm: "argon2id"}, DefaultArgon2id(), true},
+		{Config{Algorithm: "argon2id", Argon2Memory: 19456, Argon2Time: 2, Argon2Threads: 1}, Argon2id{Memory: 19456, Time: 2, Threads: 1}, true},
+		{Config{Algorithm: "bcrypt", BcryptCost: 3}, nil, false},
+		{Config{Algorithm: "bcrypt", BcryptCost: 32}, nil, false},
+		{Config{Algorithm: "argon2id", Argon2Memory: 8, Argon2Threads: 4}, nil, false},
+		{Config{Algorithm: "md5"}, nil, false},
+	}
+
+	for _, c := range cases {
+		h, err := New(c.cfg)
+		if (err == nil) != c.ok || (c.ok && h != c.want) {
+			t.Errorf("New(%+v) returned %+v, %v", c.cfg, h, err)
+		}
+	}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, h := range []Hasher{Bcrypt{Cost: 4}, testArgon2id} {
+		encoded, err := h.Hash("S3cure3Pa$$")
+		if err != nil {
+			t.Fatalf("%T failed to hash: %v \n", h, err)
+		}
+		if err := Verify(encoded, "S3cure3Pa$$"); err != nil {
+			t.Errorf("%T hash %q did not verify: %v", h, encoded, err)
+		}
+		if err := Verify(encoded, "s3cure3Pa$$"); err != ErrMismatch {
+			t.Errorf("%T hash verified a wrong password: %v", h, err)
+		}
+		if again, _ := h.Hash("S3cure3Pa$$"); again == encoded {
+			t.Errorf("%T hashes are not salted", h)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%T wants to rehash its own hash %q", h, encoded)
+		}
+	}
+
+	//hashes stored before the hasher abstraction
+	if err := Verify("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "S3cure3Pa$$"); err != nil {
+		t.Errorf("Existing bcrypt hash did not verify: %v", err)
+	}
+	for _, encoded := range []string{"", "plaintext", "$1$abc$def", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		if err := Verify(encoded, "plaintext"); err == nil || err == ErrMismatch {
+			t.Errorf("Verifying malformed hash %q returned %v", encoded, err)
+		}
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	encoded, err := testArgon2id.Hash("S3cure3Pa$$")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v \n", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Hash %q is not a PHC string with the hasher's parameters", encoded)
+	}
+	h, salt, key, err := decodeArgon2id(encoded)
+	if err != nil || h != testArgon2id || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("Decoded %q as %+v with %d byte salt and %d byte key: %v", encoded, h, len(salt), len(key), err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt10 := "$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG"
+	argon, err := testArgon2id.Hash("S3cure3Pa$$")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v \n", err)
+	}
+
+	cases := []struct {
+		hasher  Hasher
+		encoded string
+		want    bool
+	}{
+		{Bcrypt{Cost: 10}, bcrypt10, false},
+		{Bcrypt{Cost: 12}, bcrypt10, true},
+		{Bcrypt{Cost: 10}, argon, true},
+		{testArgon2id, bcrypt10, true},
+		{testArgon2id, argon, false},
+		{Argon2id{Memory: 128, Time: 1, Threads: 1}, argon, true},
+		{Argon2id{Memory: 64, Time: 2, Threads: 1}, argon, true},
+		{testArgon2id, "garbage", true},
+	}
+
+	for _, c := range cases {
+		if got := c.hasher.NeedsRehash(c.encoded); got != c.want {
+			t.Errorf("%+v.NeedsRehash(%q) = %v, want %v", c.hasher, c.encoded, got, c.want)
+		}
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	if _, err := New(Config{Algorithm: "scrypt"}); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Unknown algorithm returned %v, want %v", err, ErrUnknownAlgorithm)
+	}
+}
@@ -0,0 +1,163 @@
+package router
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type claimsKey struct{}
+
+// authenticate returns the claims of the request's bearer token (an API key or JWT), verified client certificate
+// or JWT cookie, in that order
+func (rtr *RouterService) authenticate(r *http.Request) (*utils.Claims, error) {
+	if token, ok := bearerToken(r); ok {
+		if controller.IsAPIKey(token) {
+			return rtr.Ctrlr.AuthenticateAPIKey(r.Context(), token)
+		}
+		return rtr.Ctrlr.Authenticate(r.Context(), token)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return rtr.Ctrlr.AuthenticateCertificate(r.Context(), r.TLS.VerifiedChains[0][0])
+	}
+	jwtCookie, err := r.Cookie("JWT")
+	if err != nil {
+		return nil, err
+	}
+	return rtr.Ctrlr.Authenticate(r.Context(), jwtCookie.Value)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// requireAuth only passes authenticated requests on to next, with their claims available through claimsFromContext
+func (rtr *RouterService) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rtr.addHeaders(w)
+		claims, err := rtr.authenticate(r)
+		if rtr.unavailable(w, r, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+// requireRole only passes requests on to next if they are authenticated, by bearer token, client certificate or
+// JWT cookie, as a principal with the given role, and their credential grants scope. Sessions and client certificates
+// are not limited to scopes, but API keys and OAuth tokens must have been granted scope explicitly, so that holding
+// an admin's key or token for something else does not open every route the admin may use.
+// The claims are available to next through claimsFromContext.
+func (rtr *RouterService) requireRole(role, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return rtr.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		if claims.Role != role {
+			rtr.Logger.WarnContext(r.Context(), "Insufficient role", "email", claims.Subject, "role", claims.Role, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !claims.HasScope(scope) {
+			rtr.Logger.WarnContext(r.Context(), "Insufficient scope", "email", claims.Subject, "scope", claims.Scope, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireScope rejects requests whose claims, set by requireAuth, do not grant scope
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !claimsFromContext(r.Context()).HasScope(scope) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func claimsFromContext(ctx context.Context) *utils.Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*utils.Claims)
+	return claims
+}
+
+// auditHandler returns audit events filtered by the email, from and to (RFC 3339) and limit query parameters.
+// With format=csv the events are exported as a CSV attachment instead of JSON.
+func (rtr *RouterService) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := dbmanager.AuditFilter{Email: query.Get("email")}
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := rtr.Ctrlr.PSQL.QueryAuditEvents(r.Context(), filter)
+	if rtr.unavailable(w, r, err) {
+		return
+	}
+	if err != nil {
+		rtr.Logger.ErrorContext(r.Context(), "Querying audit events failed", "error", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	rtr.Logger.InfoContext(r.Context(), "Audit events exported", "by", claimsFromContext(r.Context()).Subject, "count", len(events))
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit_events.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"id", "type", "email", "ip", "user_agent", "reason", "created"})
+		for _, ev := range events {
+			out.Write([]string{strconv.FormatInt(ev.ID, 10), ev.Type, csvSafe(ev.Email), ev.IP, csvSafe(ev.UserAgent), csvSafe(ev.Reason), ev.Created.UTC().Format(time.RFC3339)})
+		}
+		out.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// csvSafe stops client supplied values from being interpreted as formulas when the export is opened in a spreadsheet
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
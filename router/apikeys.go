@@ -0,0 +1,142 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIKeyRequest is the body of a request to create an API key. ExpiresIn uses the time.ParseDuration syntax, e.g. "720h".
+type APIKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+// APIKeyResponse describes a newly created key. Key holds the secret and is only ever returned here.
+type APIKeyResponse struct {
+	dbmanager.APIKey
+	Key string `json:"key"`
+}
+
+// apiKeysHandler lists the caller's API keys on GET and creates a new one on POST
+func (rtr *RouterService) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r.Context())
+	switch r.Method {
+	case "GET":
+		if !claims.HasScope(dbmanager.ScopeKeysRead) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		keys, err := rtr.Ctrlr.ListAPIKeys(r.Context(), claims.Subject)
+		if rtr.unavailable(w, r, err) {
+			return
+		}
+		if err != nil {
+			rtr.Logger.ErrorContext(r.Context(), "Listing API keys failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+
+	case "POST":
+		if !claims.HasScope(dbmanager.ScopeKeysWrite) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := rtr.validateCSRFHeader(w, r); err != nil {
+			rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+			return
+		}
+		var req APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		token, key, err := rtr.Ctrlr.CreateAPIKey(r.Context(), claims, req.Name, req.Scopes, ttl, clientInfo(r))
+		if rtr.unavailable(w, r, err) {
+			return
+		}
+		if errors.Is(err, controller.ErrScopeNotHeld) {
+			rtr.Logger.WarnContext(r.Context(), "Creating API key failed", "email", claims.Subject, "error", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			rtr.Logger.InfoContext(r.Context(), "Creating API key failed", "error", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(APIKeyResponse{APIKey: key, Key: token})
+
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiKeyHandler revokes one of the caller's API keys on DELETE
+func (rtr *RouterService) apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := claimsFromContext(r.Context())
+	if !claims.HasScope(dbmanager.ScopeKeysWrite) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := rtr.validateCSRFHeader(w, r); err != nil {
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = rtr.Ctrlr.RevokeAPIKey(r.Context(), claims.Subject, id, clientInfo(r))
+	if err == dbmanager.ErrAPIKeyNonexistant {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if rtr.unavailable(w, r, err) {
+		return
+	}
+	if err != nil {
+		rtr.Logger.ErrorContext(r.Context(), "Revoking API key failed", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateCSRFHeader checks the X-CSRF-Token header against the CSRF cookie for requests authenticated by cookie.
+// Requests carrying a bearer token cannot be forged by another site and are exempt.
+func (rtr *RouterService) validateCSRFHeader(w http.ResponseWriter, r *http.Request) error {
+	if _, ok := bearerToken(r); ok {
+		return nil
+	}
+	csrfCookie, err := r.Cookie("CSRF")
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return errors.New("Missing CSRF cookie")
+	}
+	if csrfCookie.Value == "" || csrfCookie.Value != r.Header.Get("X-CSRF-Token") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return errors.New("CSRF Validation Failed")
+	}
+	return nil
+}
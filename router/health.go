@@ -0,0 +1,97 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds how long /readyz waits for its dependencies
+const readinessTimeout = 2 * time.Second
+
+// ComponentStatus is the readiness of one dependency of the server
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus is the body of the /healthz and /readyz responses
+type HealthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// healthzHandler reports that the process is alive. It deliberately checks no dependencies.
+func (rtr *RouterService) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, HealthStatus{Status: "ok"})
+}
+
+// readyzHandler reports whether the server can handle logins: Postgres is reachable,
+// the schema is migrated, the JWT signing key is loaded and the server is not shutting down.
+// Database errors, which name hosts and ports, are only logged; the body just says the database is unavailable.
+func (rtr *RouterService) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.readiness(w, r, false)
+}
+
+// adminReadyzHandler is readyzHandler for the admin listener, which also reports the database error
+func (rtr *RouterService) adminReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.readiness(w, r, true)
+}
+
+func (rtr *RouterService) readiness(w http.ResponseWriter, r *http.Request, detailed bool) {
+	rtr.addHeaders(w)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"database":     rtr.Ctrlr.PSQL.Ping(ctx),
+		"migrations":   nil,
+		"signing_keys": nil,
+		"server":       nil,
+	}
+	if !rtr.Ctrlr.PSQL.Migrated() {
+		checks["migrations"] = errors.New("schema has not been initialized")
+	}
+	if !rtr.Ctrlr.TokenUtil.HasSigningKey() {
+		checks["signing_keys"] = errors.New("no JWT signing key loaded")
+	}
+	if rtr.shuttingDown.Load() {
+		checks["server"] = errors.New("shutting down")
+	}
+
+	status := HealthStatus{Status: "ok", Components: map[string]ComponentStatus{}}
+	for name, err := range checks {
+		if err != nil {
+			rtr.Logger.WarnContext(r.Context(), "Readiness check failed", "component", name, "error", err)
+			status.Status = "unavailable"
+			message := err.Error()
+			if name == "database" && !detailed {
+				message = "database unavailable"
+			}
+			status.Components[name] = ComponentStatus{Status: "unavailable", Error: message}
+			continue
+		}
+		status.Components[name] = ComponentStatus{Status: "ok"}
+	}
+	writeHealth(w, status)
+}
+
+func writeHealth(w http.ResponseWriter, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
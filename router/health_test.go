@@ -0,0 +1,98 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"iotdashboard/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+
+	cases := []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusOK},
+		{"HEAD", http.StatusOK},
+		{"POST", http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, "/healthz", nil)
+		if err != nil {
+			t.Errorf("Failed to make %v request %v \n", c.method, err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(router.healthzHandler)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != c.status {
+			t.Errorf("Handler returned wrong status code: got %v want %v \n", rr.Code, c.status)
+		}
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	refused := errors.New("dial tcp 10.0.0.5:5432: connection refused")
+	cases := []struct {
+		pingErr error
+		admin   bool
+		status  int
+		db      string
+		dbError string
+	}{
+		{nil, false, http.StatusOK, "ok", ""},
+		//the public listener does not reveal where the database is
+		{refused, false, http.StatusServiceUnavailable, "unavailable", "database unavailable"},
+		{refused, true, http.StatusServiceUnavailable, "unavailable", refused.Error()},
+	}
+
+	for _, c := range cases {
+		mock.ExpectPing().WillReturnError(c.pingErr)
+
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		if err != nil {
+			t.Errorf("Failed to make request %v \n", err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(router.readyzHandler)
+		if c.admin {
+			handler = router.adminReadyzHandler
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != c.status {
+			t.Errorf("Handler returned wrong status code: got %v want %v \n", rr.Code, c.status)
+		}
+		var body HealthStatus
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatalf("Response is not valid JSON: %v \n", err)
+		}
+		if body.Components["database"].Status != c.db || body.Components["database"].Error != c.dbError ||
+			body.Components["signing_keys"].Status != "ok" {
+			t.Errorf("Unexpected component status: %+v \n", body.Components)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// IntrospectRequest is the JSON body accepted by /introspect. A form encoded token field works as well.
+type IntrospectRequest struct {
+	Token string `json:"token"`
+}
+
+// tokenIntrospectHandler lets downstream services validate a JWT or API key presented to them, such as the JWT cookie.
+// Responses carry a Cache-Control max-age so callers can cache them, bounded by the token's remaining lifetime
+// and IntrospectCacheTTL, which limits how long a logout can go unnoticed.
+func (rtr *RouterService) tokenIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var req IntrospectRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Token = r.PostFormValue("token")
+	}
+	if req.Token == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	result, err := rtr.Ctrlr.IntrospectToken(r.Context(), req.Token)
+	if rtr.unavailable(w, r, err) {
+		return
+	}
+	maxAge := rtr.cfg.IntrospectCacheTTL
+	if result.Active && result.ExpiresAt != 0 {
+		if remaining := time.Until(time.Unix(result.ExpiresAt, 0)); remaining < maxAge {
+			maxAge = remaining
+		}
+	}
+	if seconds := int(maxAge.Seconds()); seconds > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", seconds))
+	}
+	w.Header().Set("Vary", "Authorization, Cookie")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
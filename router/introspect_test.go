@@ -0,0 +1,102 @@
+package router
+
+import (
+	"encoding/json"
+	"iotdashboard/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTokenIntrospectHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	// the caller's token is checked before the introspected one, unless the request is rejected first
+	mock.MatchExpectationsInOrder(false)
+	mux := router.routes()
+
+	service, err := router.Ctrlr.TokenUtil.CreateScopedJWT("billing", "user", "tokens:introspect", "billing", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	unscoped, err := router.Ctrlr.TokenUtil.CreateScopedJWT("grafana", "user", "audit:read", "grafana", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	session, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	loggedOut, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	router.Ctrlr.TokenUtil.BlockListToken(loggedOut, time.Now().Add(time.Second*15))
+
+	cases := []struct {
+		method, caller, contentType, body string
+		status                            int
+		active                            bool
+	}{
+		{"POST", service, "application/json", `{"token":"` + session + `"}`, http.StatusOK, true},
+		{"POST", service, "application/x-www-form-urlencoded", "token=" + session, http.StatusOK, true},
+		{"POST", service, "application/json", `{"token":"` + loggedOut + `"}`, http.StatusOK, false},
+		{"POST", service, "application/json", `{"token":"garbage"}`, http.StatusOK, false},
+		{"POST", service, "application/json", `{}`, http.StatusBadRequest, false},
+		{"POST", unscoped, "application/json", `{"token":"` + session + `"}`, http.StatusForbidden, false},
+		{"POST", "", "application/json", `{"token":"` + session + `"}`, http.StatusUnauthorized, false},
+		{"GET", service, "", "", http.StatusMethodNotAllowed, false},
+	}
+
+	for _, c := range cases {
+		if c.caller != "" {
+			expectSessionCheck(mock)
+		}
+		if c.active {
+			expectSessionCheck(mock)
+		}
+		req := httptest.NewRequest(c.method, "/introspect", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		if c.caller != "" {
+			req.Header.Set("Authorization", "Bearer "+c.caller)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("Introspection of %s returned %v, want %v", c.body, rr.Code, c.status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		var result map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode introspection: %v \n", err)
+		}
+		if result["active"] != c.active {
+			t.Errorf("Introspection of %s returned %v", c.body, result)
+		}
+		if c.active && (result["sub"] != "user@gmail.com" || result["session_id"] == nil || result["exp"] == nil) {
+			t.Errorf("Active token is missing details: %v", result)
+		}
+		//the token expires in 15s, below the default cache TTL
+		if cacheControl := rr.Header().Get("Cache-Control"); c.active && cacheControl != "private, max-age=14" && cacheControl != "private, max-age=15" {
+			t.Errorf("Unexpected caching hint %q", cacheControl)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"net/http"
+)
+
+// InvitationRequest is the body of a request to invite a user
+type InvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// AcceptInvitationRequest is the body of a request to accept an invitation by choosing a password
+type AcceptInvitationRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// invitationsHandler lets admins invite a user by email on POST
+func (rtr *RouterService) invitationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rtr.validateCSRFHeader(w, r); err != nil {
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+		return
+	}
+	req := InvitationRequest{Role: dbmanager.RoleUser}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	err := rtr.Ctrlr.InviteUser(r.Context(), claimsFromContext(r.Context()).Subject, req.Email, req.Role, clientInfo(r))
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusCreated)
+	case errors.Is(err, controller.ErrInvalidInvitation):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == dbmanager.ErrUserExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == mailer.ErrDisabled:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case rtr.unavailable(w, r, err):
+	default:
+		rtr.Logger.ErrorContext(r.Context(), "Inviting user failed", "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+}
+
+// inviteHandler serves the link sent to invitees: GET returns the invitation for the token query parameter,
+// POST accepts it with the chosen password
+func (rtr *RouterService) inviteHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	switch r.Method {
+	case "GET":
+		inv, err := rtr.Ctrlr.Invitation(r.Context(), r.URL.Query().Get("token"))
+		if rtr.unavailable(w, r, err) {
+			return
+		}
+		if err == dbmanager.ErrInvitationNonexistant {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			rtr.Logger.ErrorContext(r.Context(), "Looking up invitation failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inv)
+
+	case "POST":
+		var req AcceptInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		email, err := rtr.Ctrlr.AcceptInvitation(r.Context(), req.Token, req.Password, clientInfo(r))
+		switch {
+		case err == nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"email": email})
+		case errors.Is(err, controller.ErrInvalidPassword):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err == dbmanager.ErrInvitationNonexistant:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case rtr.unavailable(w, r, err):
+		default:
+			rtr.Logger.ErrorContext(r.Context(), "Accepting invitation failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
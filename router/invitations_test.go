@@ -0,0 +1,144 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"iotdashboard/config"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInvitationsHandler(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	router.Ctrlr.Invites = controller.InviteOptions{Mailer: &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}}
+
+	adminToken, err := router.Ctrlr.TokenUtil.CreateJWT("admin@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	userToken, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "user", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+
+	cases := []struct {
+		jwt      string
+		req      InvitationRequest
+		upserted int64
+		status   int
+	}{
+		{adminToken, InvitationRequest{Email: "new@gmail.com", Role: "user"}, 1, http.StatusCreated},
+		{adminToken, InvitationRequest{Email: "user@gmail.com", Role: "user"}, 0, http.StatusConflict},
+		{adminToken, InvitationRequest{Email: "new@gmail.com", Role: "root"}, -1, http.StatusBadRequest},
+		{userToken, InvitationRequest{Email: "new@gmail.com", Role: "admin"}, -1, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		expectSessionCheck(mock)
+		if c.upserted >= 0 {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WithArgs(c.req.Email, c.req.Role, "invited").
+				WillReturnResult(sqlmock.NewResult(0, c.upserted))
+		}
+		if c.upserted == 1 {
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations")).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("user_invite", c.req.Email, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		} else if c.upserted == 0 {
+			mock.ExpectRollback()
+		}
+
+		body, _ := json.Marshal(c.req)
+		req := httptest.NewRequest("POST", "/admin/invitations", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+c.jwt)
+		rr := httptest.NewRecorder()
+		router.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAdmin, router.invitationsHandler).ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("Inviting %q as %q returned %v, want %v", c.req.Email, c.req.Role, rr.Code, c.status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInviteHandler(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	lookup := regexp.QuoteMeta("FROM invitations i JOIN users u ON u.email = i.email WHERE i.hash = $1")
+	columns := []string{"email", "role", "invited_by", "expires", "created"}
+	mock.ExpectQuery(lookup).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(lookup).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow("user@gmail.com", "user", "admin@gmail.com", time.Now().Add(time.Hour), time.Now()))
+	for _, status := range []int{http.StatusNotFound, http.StatusOK} {
+		rr := httptest.NewRecorder()
+		router.inviteHandler(rr, httptest.NewRequest("GET", "/invite?token=abc", nil))
+		if rr.Code != status {
+			t.Errorf("Looking up invitation returned %v, want %v", rr.Code, status)
+		}
+	}
+
+	consume := regexp.QuoteMeta("DELETE FROM invitations WHERE hash = $1")
+	cases := []struct {
+		req    AcceptInvitationRequest
+		status int
+	}{
+		{AcceptInvitationRequest{"abc", "short"}, http.StatusBadRequest},
+		{AcceptInvitationRequest{"abc", "S3cure3Pa$$"}, http.StatusOK},
+		//the link can only be used once
+		{AcceptInvitationRequest{"abc", "S3cure3Pa$$"}, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		switch c.status {
+		case http.StatusOK:
+			mock.ExpectBegin()
+			mock.ExpectQuery(consume).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $2, status = $3")).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+		case http.StatusNotFound:
+			mock.ExpectBegin()
+			mock.ExpectQuery(consume).WillReturnRows(sqlmock.NewRows([]string{"email"}))
+			mock.ExpectRollback()
+		}
+		body, _ := json.Marshal(c.req)
+		rr := httptest.NewRecorder()
+		router.inviteHandler(rr, httptest.NewRequest("POST", "/invite", bytes.NewReader(body)))
+		if rr.Code != c.status {
+			t.Errorf("Accepting invitation returned %v, want %v", rr.Code, c.status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("iotdashboard/router")
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// handle registers h on mux, instrumented with the pattern as its route label
+func (rtr *RouterService) handle(mux *http.ServeMux, pattern string, h http.Handler) {
+	mux.Handle(pattern, rtr.instrument(pattern, h))
+}
+
+// instrument records the count and latency of requests served by next and traces them in a server span
+// whose parent is taken from the request's W3C trace-context headers.
+// The route label is fixed per handler so that arbitrary request paths cannot inflate cardinality.
+func (rtr *RouterService) instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := methodLabel(r.Method)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("http.route", route),
+		))
+		defer span.End()
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sr.status))
+		if sr.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sr.status))
+		}
+
+		rtr.Metrics.HTTPDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+		rtr.Metrics.HTTPRequests.WithLabelValues(route, method, strconv.Itoa(sr.status)).Inc()
+	})
+}
+
+// methodLabel folds non-standard methods together for the same reason
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "OTHER"
+}
+
+// adminMux serves the operational endpoints of the admin listener
+func (rtr *RouterService) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rtr.Metrics.Handler())
+	mux.HandleFunc("/healthz", rtr.healthzHandler)
+	mux.HandleFunc("/readyz", rtr.adminReadyzHandler)
+	return mux
+}
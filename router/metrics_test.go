@@ -0,0 +1,95 @@
+package router
+
+import (
+	"iotdashboard/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestInstrument(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/csrf", http.StatusOK},
+		{"POST", "/csrf?1231", http.StatusMethodNotAllowed},
+		{"BREW", "/csrf", http.StatusMethodNotAllowed},
+	}
+
+	handler := router.instrument("/csrf", http.HandlerFunc(router.csrfHandler))
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.path, nil)
+		if err != nil {
+			t.Errorf("Failed to make %v request %v \n", c.method, err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("Handler returned wrong status code: got %v want %v \n", rr.Code, c.status)
+		}
+	}
+
+	//Scrape the admin listener's metrics endpoint
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request %v \n", err)
+	}
+	rr := httptest.NewRecorder()
+	router.adminMux().ServeHTTP(rr, req)
+
+	expected := []string{
+		`iotdash_http_requests_total{method="GET",route="/csrf",status="200"} 1`,
+		`iotdash_http_requests_total{method="POST",route="/csrf",status="405"} 1`,
+		`iotdash_http_requests_total{method="OTHER",route="/csrf",status="405"} 1`,
+		`iotdash_blocklist_size 0`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(rr.Body.String(), e) {
+			t.Errorf("Metrics output is missing %q \n", e)
+		}
+	}
+}
+
+func TestInstrumentTracing(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	req, err := http.NewRequest("GET", "/csrf", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request %v \n", err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	router.instrument("/csrf", http.HandlerFunc(router.csrfHandler)).ServeHTTP(rr, req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d \n", len(spans))
+	}
+	if spans[0].Name() != "GET /csrf" {
+		t.Errorf("Unexpected span name: %v \n", spans[0].Name())
+	}
+	if spans[0].Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Span did not continue the incoming trace: %v \n", spans[0].Parent().TraceID())
+	}
+}
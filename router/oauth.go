@@ -0,0 +1,332 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"net/http"
+	"net/url"
+)
+
+// ConsentScope is a requested scope as shown on the consent screen
+type ConsentScope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ConsentData is what the frontend needs to ask a user whether to grant an authorization request
+type ConsentData struct {
+	ClientID    string         `json:"client_id"`
+	ClientName  string         `json:"client_name"`
+	Scopes      []ConsentScope `json:"scopes"`
+	RedirectURI string         `json:"redirect_uri"`
+}
+
+// ConsentDecision is posted by the frontend once the user approved or denied an authorization request
+type ConsentDecision struct {
+	controller.AuthorizationRequest
+	Approve bool `json:"approve"`
+}
+
+// OAuthClientRequest is the body of a request to register an OAuth client
+type OAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Role         string   `json:"role"`
+	Confidential bool     `json:"confidential"`
+}
+
+// OAuthClientResponse describes a newly registered client. ClientSecret is only ever returned here.
+type OAuthClientResponse struct {
+	dbmanager.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func authorizationRequest(query url.Values) controller.AuthorizationRequest {
+	return controller.AuthorizationRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+}
+
+// redirectURL adds params to a client's redirect URI, keeping any query it was registered with
+func redirectURL(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := u.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// errorRedirect reports an authorization error back to the client as described in RFC 6749 section 4.1.2.1
+func errorRedirect(req controller.AuthorizationRequest, err error) string {
+	params := url.Values{"error": {"server_error"}}
+	var oauthErr *controller.OAuthError
+	if controller.IsUnavailable(err) {
+		params.Set("error", "temporarily_unavailable")
+	} else if errors.As(err, &oauthErr) {
+		params.Set("error", oauthErr.Code)
+		params.Set("error_description", oauthErr.Description)
+	}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return redirectURL(req.RedirectURI, params)
+}
+
+// authorizeHandler is the authorization endpoint. Valid requests are handed to the frontend's consent page.
+func (rtr *RouterService) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if r.Method != "GET" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	req := authorizationRequest(r.URL.Query())
+	_, _, err := rtr.Ctrlr.ValidateAuthorizationRequest(r.Context(), &req)
+	if err == controller.ErrInvalidRedirect {
+		http.Error(w, "Invalid client or redirect URI", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		rtr.Logger.InfoContext(r.Context(), "Authorization request rejected", "client_id", req.ClientID, "error", err)
+		http.Redirect(w, r, errorRedirect(req, err), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/#/oauth/consent?"+r.URL.RawQuery, http.StatusFound)
+}
+
+// consentHandler serves the consent screen data for an authorization request on GET,
+// and records the user's decision on POST, answering with the URI to send the user back to.
+// Only interactive sessions can consent, not API keys or tokens issued to other clients.
+func (rtr *RouterService) consentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r.Context())
+	if claims.Scope != "" || claims.ClientID != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var decision ConsentDecision
+	switch r.Method {
+	case "GET":
+		decision.AuthorizationRequest = authorizationRequest(r.URL.Query())
+	case "POST":
+		if err := rtr.validateCSRFHeader(w, r); err != nil {
+			rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := decision.AuthorizationRequest
+	client, scopes, err := rtr.Ctrlr.ValidateAuthorizationRequest(r.Context(), &req)
+	if err == controller.ErrInvalidRedirect {
+		http.Error(w, "Invalid client or redirect URI", http.StatusBadRequest)
+		return
+	}
+	redirectTo := ""
+	switch {
+	case err != nil:
+		redirectTo = errorRedirect(req, err)
+	case r.Method == "GET":
+		consent := ConsentData{ClientID: client.ClientID, ClientName: client.Name, RedirectURI: req.RedirectURI}
+		for _, scope := range scopes {
+			consent.Scopes = append(consent.Scopes, ConsentScope{scope, dbmanager.ScopeDescriptions[scope]})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(consent)
+		return
+	case !decision.Approve:
+		rtr.Ctrlr.DenyAuthorization(r.Context(), claims.Subject, req, clientInfo(r))
+		redirectTo = errorRedirect(req, &controller.OAuthError{Code: "access_denied", Description: "The user denied the request"})
+	default:
+		code, err := rtr.Ctrlr.Authorize(r.Context(), claims.Subject, req, scopes, clientInfo(r))
+		if err != nil {
+			rtr.Logger.ErrorContext(r.Context(), "Issuing authorization code failed", "error", err)
+			redirectTo = errorRedirect(req, err)
+			break
+		}
+		params := url.Values{"code": {code}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		redirectTo = redirectURL(req.RedirectURI, params)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"redirect_to": redirectTo})
+}
+
+// authenticateOAuthClient reads client credentials from HTTP Basic authentication or the form body (RFC 6749 section 2.3.1)
+func (rtr *RouterService) authenticateOAuthClient(r *http.Request) (dbmanager.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// Basic credentials are form encoded before being base64 encoded
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			return dbmanager.OAuthClient{}, &controller.OAuthError{Code: "invalid_client", Description: "Malformed client credentials"}
+		}
+	} else {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	return rtr.Ctrlr.AuthenticateOAuthClient(r.Context(), clientID, secret)
+}
+
+// writeOAuthError answers a token, introspection or revocation request with an RFC 6749 error response
+func (rtr *RouterService) writeOAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	var oauthErr *controller.OAuthError
+	if controller.IsUnavailable(err) {
+		rtr.Logger.WarnContext(r.Context(), "OAuth request aborted", "error", err)
+		oauthErr = &controller.OAuthError{Code: "temporarily_unavailable"}
+		status = http.StatusServiceUnavailable
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+	} else if !errors.As(err, &oauthErr) {
+		rtr.Logger.ErrorContext(r.Context(), "OAuth request failed", "error", err)
+		oauthErr = &controller.OAuthError{Code: "server_error"}
+		status = http.StatusInternalServerError
+	} else if oauthErr.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		status = http.StatusUnauthorized
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthErr)
+}
+
+// tokenHandler is the token endpoint, supporting the authorization_code and client_credentials grants
+func (rtr *RouterService) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	w.Header().Set("Pragma", "no-cache")
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := rtr.authenticateOAuthClient(r)
+	if err != nil {
+		rtr.writeOAuthError(w, r, err)
+		return
+	}
+
+	var token controller.TokenResponse
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		token, err = rtr.Ctrlr.ExchangeAuthorizationCode(r.Context(), client,
+			r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+	case "client_credentials":
+		token, err = rtr.Ctrlr.ClientCredentialsToken(r.Context(), client, r.PostFormValue("scope"))
+	default:
+		err = &controller.OAuthError{Code: "unsupported_grant_type"}
+	}
+	if err != nil {
+		rtr.writeOAuthError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// introspectHandler implements RFC 7662 token introspection for confidential clients. Public clients are refused,
+// since their client IDs appear in every authorization URL and would let anyone probe stolen tokens.
+func (rtr *RouterService) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := rtr.authenticateOAuthClient(r)
+	if err == nil && !client.Confidential {
+		err = &controller.OAuthError{Code: "invalid_client", Description: "Only confidential clients may introspect tokens"}
+	}
+	if err != nil {
+		rtr.writeOAuthError(w, r, err)
+		return
+	}
+	result, err := rtr.Ctrlr.IntrospectToken(r.Context(), r.PostFormValue("token"))
+	if err != nil {
+		rtr.writeOAuthError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// revokeHandler implements RFC 7009 token revocation for authenticated clients
+func (rtr *RouterService) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := rtr.authenticateOAuthClient(r)
+	if err != nil {
+		rtr.writeOAuthError(w, r, err)
+		return
+	}
+	rtr.Ctrlr.RevokeToken(r.Context(), client, r.PostFormValue("token"))
+}
+
+// oauthClientsHandler lists registered OAuth clients on GET and registers a new one on POST
+func (rtr *RouterService) oauthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		clients, err := rtr.Ctrlr.ListOAuthClients(r.Context())
+		if err != nil {
+			rtr.Logger.ErrorContext(r.Context(), "Listing OAuth clients failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+
+	case "POST":
+		if err := rtr.validateCSRFHeader(w, r); err != nil {
+			rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+			return
+		}
+		var req OAuthClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		secret, client, err := rtr.Ctrlr.RegisterOAuthClient(r.Context(), claimsFromContext(r.Context()).Subject, dbmanager.OAuthClient{
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+			Scopes:       req.Scopes,
+			Role:         req.Role,
+			Confidential: req.Confidential,
+		}, clientInfo(r))
+		if err != nil {
+			rtr.Logger.InfoContext(r.Context(), "Registering OAuth client failed", "error", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(OAuthClientResponse{OAuthClient: client, ClientSecret: secret})
+
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
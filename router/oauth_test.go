@@ -0,0 +1,258 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"iotdashboard/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	mux := router.routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	session, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "user", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	verifier := strings.Repeat("v", 64)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"cli"},
+		"redirect_uri":          {"http://127.0.0.1:8400/cb"},
+		"scope":                 {"keys:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	expectClient := func() {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).WithArgs("cli").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}).
+				AddRow(1, "cli", "Command line", nil, "http://127.0.0.1:8400/cb", "keys:read keys:write", "user", time.Now()))
+	}
+
+	//the authorization endpoint hands valid requests to the consent page
+	expectClient()
+	rr := serve(httptest.NewRequest("GET", "/oauth/authorize?"+params.Encode(), nil))
+	if rr.Code != http.StatusFound || !strings.HasPrefix(rr.Header().Get("Location"), "/#/oauth/consent?") {
+		t.Fatalf("Authorization endpoint returned %v to %s \n", rr.Code, rr.Header().Get("Location"))
+	}
+
+	expectSessionCheck(mock)
+	expectClient()
+	req := httptest.NewRequest("GET", "/oauth/consent?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: session})
+	rr = serve(req)
+	var consent ConsentData
+	if err := json.NewDecoder(rr.Body).Decode(&consent); err != nil || consent.ClientName != "Command line" || len(consent.Scopes) != 1 {
+		t.Fatalf("Unexpected consent data %+v: %v \n", consent, err)
+	}
+
+	expectSessionCheck(mock)
+	expectClient()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM oauth_codes WHERE expires")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_codes")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+	decision := map[string]interface{}{"approve": true}
+	for key := range params {
+		decision[key] = params.Get(key)
+	}
+	body, _ := json.Marshal(decision)
+	req = httptest.NewRequest("POST", "/oauth/consent", strings.NewReader(string(body)))
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: session})
+	req.AddCookie(&http.Cookie{Name: "CSRF", Value: "csrf-token"})
+	req.Header.Set("X-CSRF-Token", "csrf-token")
+	rr = serve(req)
+	var redirect map[string]string
+	json.NewDecoder(rr.Body).Decode(&redirect)
+	target, err := url.Parse(redirect["redirect_to"])
+	if err != nil || target.Query().Get("state") != "xyz" || target.Query().Get("code") == "" {
+		t.Fatalf("Consent returned %v with redirect %q \n", rr.Code, redirect["redirect_to"])
+	}
+
+	//the code is exchanged for a scoped token
+	expectClient()
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM oauth_codes WHERE hash = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "email", "redirect_uri", "scopes", "code_challenge", "expires"}).
+			AddRow("cli", "user@gmail.com", "http://127.0.0.1:8400/cb", "keys:read", params.Get("code_challenge"), time.Now().Add(time.Minute)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).AddRow(1, "user@gmail.com", "", "user", "active", nil, time.Now()))
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"cli"},
+		"code":          {target.Query().Get("code")},
+		"redirect_uri":  {"http://127.0.0.1:8400/cb"},
+		"code_verifier": {verifier},
+	}
+	req = httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = serve(req)
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&token); err != nil || token.AccessToken == "" || token.Scope != "keys:read" {
+		t.Fatalf("Token endpoint returned %v: %+v \n", rr.Code, token)
+	}
+
+	//the token may not be used beyond its scope, nor to consent on the user's behalf
+	expectSessionCheck(mock)
+	req = httptest.NewRequest("DELETE", "/api/keys/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if rr := serve(req); rr.Code != http.StatusForbidden {
+		t.Errorf("Token was used beyond its scope: %v", rr.Code)
+	}
+	expectSessionCheck(mock)
+	req = httptest.NewRequest("GET", "/oauth/consent?"+params.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if rr := serve(req); rr.Code != http.StatusForbidden {
+		t.Errorf("Token was used to consent: %v", rr.Code)
+	}
+
+	//introspection by a confidential client, and revocation
+	secretHash := sha256.Sum256([]byte("s3cret"))
+	introspect := func(active bool) map[string]interface{} {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).WithArgs("grafana").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}).
+				AddRow(2, "grafana", "Grafana", hex.EncodeToString(secretHash[:]), "", "", "user", time.Now()))
+		if active {
+			expectSessionCheck(mock)
+		}
+		req := httptest.NewRequest("POST", "/oauth/introspect", strings.NewReader(url.Values{"token": {token.AccessToken}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("grafana", "s3cret")
+		var result map[string]interface{}
+		json.NewDecoder(serve(req).Body).Decode(&result)
+		return result
+	}
+	if result := introspect(true); result["active"] != true || result["sub"] != "user@gmail.com" || result["client_id"] != "cli" {
+		t.Errorf("Unexpected introspection: %v", result)
+	}
+	expectClient()
+	req = httptest.NewRequest("POST", "/oauth/revoke", strings.NewReader(url.Values{"token": {token.AccessToken}, "client_id": {"cli"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rr := serve(req); rr.Code != http.StatusOK {
+		t.Errorf("Revocation returned %v", rr.Code)
+	}
+	if result := introspect(false); result["active"] != false || len(result) != 1 {
+		t.Errorf("Revoked token is still described: %v", result)
+	}
+
+	//public client IDs are no secret, so they cannot be used to probe tokens
+	expectClient()
+	req = httptest.NewRequest("POST", "/oauth/introspect", strings.NewReader(url.Values{"token": {token.AccessToken}, "client_id": {"cli"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rr := serve(req); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "invalid_client") {
+		t.Errorf("Public client got %v from introspection: %s", rr.Code, rr.Body.String())
+	}
+
+	//unknown clients cannot use the token endpoint
+	mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	req = httptest.NewRequest("POST", "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("unknown", "secret")
+	if rr := serve(req); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "invalid_client") {
+		t.Errorf("Unknown client got %v: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuthorizeRejectsUnknownRedirect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE client_id = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}).
+			AddRow(1, "cli", "Command line", nil, "http://127.0.0.1:8400/cb", "keys:read", "user", time.Now()))
+	rr := httptest.NewRecorder()
+	router.authorizeHandler(rr, httptest.NewRequest("GET", "/oauth/authorize?response_type=code&client_id=cli&redirect_uri=https://attacker.example.org/", nil))
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+		t.Errorf("Unregistered redirect URI returned %v to %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestOAuthTokensNeedAdminScope(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	mux := router.routes()
+
+	//tokens issued to a third-party client on behalf of an admin carry the admin's role
+	cases := []struct {
+		scope  string
+		status int
+	}{
+		{"tokens:introspect", http.StatusForbidden},
+		{"", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	}
+	for _, c := range cases {
+		token, err := router.Ctrlr.TokenUtil.CreateScopedJWT("admin@gmail.com", "admin", c.scope, "grafana", time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+		}
+		expectSessionCheck(mock)
+		if c.status == http.StatusOK {
+			mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients ORDER BY created")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "name", "secret_hash", "redirect_uris", "scopes", "role", "created"}))
+		}
+		req := httptest.NewRequest("GET", "/admin/oauth/clients", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("OAuth token with scope %q returned %v, want %v", c.scope, rr.Code, c.status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
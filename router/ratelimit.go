@@ -0,0 +1,72 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each key, such as a client IP, a fixed number of requests per window
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	hits   map[string]*rateWindow
+	pruned time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, now: time.Now, hits: make(map[string]*rateWindow)}
+}
+
+// allow counts a request for key and reports whether it is within the limit.
+// If not, it also returns how long until the key's window resets.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// drop the windows of clients that have gone quiet, so the map does not grow without bound
+	if now.Sub(l.pruned) >= l.window {
+		for k, w := range l.hits {
+			if now.Sub(w.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+		l.pruned = now
+	}
+	w, ok := l.hits[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.hits[key] = w
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// rateLimit answers 429 Too Many Requests once a client IP exceeds the limiter's rate, instead of calling next.
+// A nil limiter does not limit.
+func (rtr *RouterService) rateLimit(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l != nil {
+			if ok, retry := l.allow(clientInfo(r).IP); !ok {
+				rtr.Logger.WarnContext(r.Context(), "Rate limit exceeded", "ip", clientInfo(r).IP, "path", r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
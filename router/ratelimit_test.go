@@ -0,0 +1,53 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	cases := []struct {
+		key     string
+		advance time.Duration
+		allowed bool
+	}{
+		{"10.0.0.1", 0, true},
+		{"10.0.0.1", time.Second, true},
+		{"10.0.0.1", time.Second, false},
+		//other clients have their own budget
+		{"10.0.0.2", 0, true},
+		//the window resets
+		{"10.0.0.1", time.Minute, true},
+	}
+	for i, c := range cases {
+		now = now.Add(c.advance)
+		if allowed, _ := l.allow(c.key); allowed != c.allowed {
+			t.Errorf("Request %d from %s allowed = %v, want %v", i, c.key, allowed, c.allowed)
+		}
+	}
+	if len(l.hits) != 1 {
+		t.Errorf("Expired windows were not pruned: %v", l.hits)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rtr := &RouterService{Logger: testLogger}
+	handler := rtr.rateLimit(newRateLimiter(1, time.Hour), func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/register", nil))
+		if rr.Code != status {
+			t.Errorf("Handler returned %v, want %v", rr.Code, status)
+		}
+		if status == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "3600" {
+			t.Errorf("Unexpected Retry-After %q", rr.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"iotdashboard/mailer"
+	"net/http"
+	"strconv"
+)
+
+// registerHandler signs up the email of the posted Credentials; the password is not used, as the new user chooses it
+// through the emailed invitation link. The response is the same whether or not the email already has an account.
+func (rtr *RouterService) registerHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if rtr.Ctrlr.Registration.Mode != controller.RegistrationOpen && rtr.Ctrlr.Registration.Mode != controller.RegistrationApproval {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err := rtr.validateCSRF(w, r, creds); err != nil {
+		// error is returned to client in validateCSRF function
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+		return
+	}
+
+	err := rtr.Ctrlr.Register(r.Context(), creds.Email, clientInfo(r))
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]bool{"approval_required": rtr.Ctrlr.Registration.Mode == controller.RegistrationApproval})
+	case errors.Is(err, controller.ErrInvalidInvitation):
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+	case err == controller.ErrDomainNotAllowed:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err == mailer.ErrDisabled:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case rtr.unavailable(w, r, err):
+	default:
+		rtr.Logger.ErrorContext(r.Context(), "Registration failed", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// registrationsHandler lists the registrations waiting for approval on GET
+func (rtr *RouterService) registrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	registrations, err := rtr.Ctrlr.PSQL.ListRegistrations(r.Context())
+	if rtr.unavailable(w, r, err) {
+		return
+	}
+	if err != nil {
+		rtr.Logger.ErrorContext(r.Context(), "Listing registrations failed", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registrations)
+}
+
+// registrationHandler approves a queued registration on POST, which invites the user, and rejects it on DELETE
+func (rtr *RouterService) registrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rtr.validateCSRFHeader(w, r); err != nil {
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	actor := claimsFromContext(r.Context()).Subject
+	if r.Method == "POST" {
+		err = rtr.Ctrlr.ApproveRegistration(r.Context(), actor, id, clientInfo(r))
+	} else {
+		err = rtr.Ctrlr.RejectRegistration(r.Context(), actor, id, clientInfo(r))
+	}
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case err == dbmanager.ErrRegistrationNonexistant:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	case err == dbmanager.ErrUserExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == mailer.ErrDisabled:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case rtr.unavailable(w, r, err):
+	default:
+		rtr.Logger.ErrorContext(r.Context(), "Deciding on registration failed", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
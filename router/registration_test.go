@@ -0,0 +1,165 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"iotdashboard/config"
+	"iotdashboard/controller"
+	"iotdashboard/mailer"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRegisterHandler(t *testing.T) {
+	cfg := config.Default()
+	cfg.RegistrationMode = controller.RegistrationOpen
+	cfg.RegistrationDomains = "Example.com"
+	cfg.RegistrationRateLimit = 4
+	router, err := NewRouter(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	router.Ctrlr.Invites.Mailer = &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}
+
+	cases := []struct {
+		email, csrf string
+		status      int
+	}{
+		{"op@example.com", "token", http.StatusAccepted},
+		{"op@example.com", "forged", http.StatusUnauthorized},
+		{"op@gmail.com", "token", http.StatusForbidden},
+		{"op", "token", http.StatusBadRequest},
+		//four attempts per hour are allowed
+		{"op@example.com", "token", http.StatusTooManyRequests},
+	}
+
+	handler := router.rateLimit(router.registerLimiter, router.registerHandler)
+	for _, c := range cases {
+		if c.status == http.StatusAccepted {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WithArgs(c.email, "user", "invited").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations")).WithArgs(c.email, sqlmock.AnyArg(), "self-registration", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		body, _ := json.Marshal(Credentials{Email: c.email, CSRF: c.csrf})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "CSRF", Value: "token"})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("Registering %q returned %v, want %v", c.email, rr.Code, c.status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	//registration can be switched off entirely
+	router.Ctrlr.Registration.Mode = controller.RegistrationDisabled
+	rr := httptest.NewRecorder()
+	router.registerHandler(rr, httptest.NewRequest("POST", "/register", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Disabled registration returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestRegistrationApproval(t *testing.T) {
+	cfg := config.Default()
+	cfg.RegistrationMode = controller.RegistrationApproval
+	router, err := NewRouter(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	router.Ctrlr.Invites.Mailer = &mailer.FileSender{Dir: t.TempDir(), From: "noreply@example.com"}
+
+	//registering queues the request
+	mock.ExpectQuery(regexp.QuoteMeta("from users WHERE email = $1")).WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO registrations(email,ip,user_agent)")).WithArgs("op@example.com", "192.0.2.1", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("register", "op@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	body, _ := json.Marshal(Credentials{Email: "op@example.com", CSRF: "token"})
+	req := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: "CSRF", Value: "token"})
+	rr := httptest.NewRecorder()
+	router.registerHandler(rr, req)
+	var resp map[string]bool
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); rr.Code != http.StatusAccepted || err != nil || !resp["approval_required"] {
+		t.Fatalf("Registering returned %v: %q \n", rr.Code, rr.Body.String())
+	}
+
+	adminToken, err := router.Ctrlr.TokenUtil.CreateJWT("admin@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+	regRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "email", "ip", "user_agent", "created"}).AddRow(7, "op@example.com", "192.0.2.1", "", time.Now())
+	}
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/admin/registrations", http.StatusOK},
+		{"POST", "/admin/registrations/7", http.StatusNoContent},
+		{"DELETE", "/admin/registrations/7", http.StatusNoContent},
+		{"DELETE", "/admin/registrations/8", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		expectSessionCheck(mock)
+		switch {
+		case c.method == "GET":
+			mock.ExpectQuery(regexp.QuoteMeta("FROM registrations ORDER BY id")).WillReturnRows(regRow())
+		case c.status == http.StatusNotFound:
+			mock.ExpectQuery(regexp.QuoteMeta("FROM registrations WHERE id = $1")).WithArgs(8).WillReturnRows(sqlmock.NewRows(nil))
+		case c.method == "POST":
+			mock.ExpectQuery(regexp.QuoteMeta("FROM registrations WHERE id = $1")).WithArgs(7).WillReturnRows(regRow())
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role,status)")).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM invitations")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invitations")).WithArgs("op@example.com", sqlmock.AnyArg(), "admin@gmail.com", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("user_invite", "op@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM registrations WHERE id = $1;")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+		default:
+			mock.ExpectQuery(regexp.QuoteMeta("FROM registrations WHERE id = $1")).WithArgs(7).WillReturnRows(regRow())
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM registrations WHERE id = $1;")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WithArgs("register_reject", "op@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "by admin@gmail.com").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		router.routes().ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("%s %s returned %v, want %v", c.method, c.path, rr.Code, c.status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
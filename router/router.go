@@ -1,63 +1,262 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"iotdashboard/certs"
+	"iotdashboard/config"
 	"iotdashboard/controller"
-	"log"
+	"iotdashboard/dbmanager"
+	"iotdashboard/metrics"
+	"iotdashboard/utils"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
 type RouterService struct {
-	Ctrlr     *controller.ControllerService
-	httpPort  string
-	httpsPort string
-	certPath  string
-	keyPath   string
+	Ctrlr   *controller.ControllerService
+	Logger  *slog.Logger
+	Metrics *metrics.Metrics
+	cfg     config.Config
+
+	redirectServer *http.Server
+	httpsServer    *http.Server
+	adminServer    *http.Server
+	certStore      atomic.Pointer[certs.Store]
+	shuttingDown   atomic.Bool
+	// registerLimiter bounds how often a client IP may call /register
+	registerLimiter *rateLimiter
 }
 
-// Credentials is a struct that holds the email, password, and CSRF token of a request
+// Credentials is a struct that holds the email or username, password, and CSRF token of a request
 type Credentials struct {
-	Email    string `json:"email"`
+	Email string `json:"email"`
+	// Username can be given instead of Email to log in
+	Username string `json:"username,omitempty"`
 	Password string `json:"password"`
 	CSRF     string `json:"csrf"`
 }
 
-func NewRouter(httpPort, httpsPort, certPath, keyPath string) (*RouterService, error) {
-	Ctrlr, err := controller.NewController()
+func NewRouter(cfg config.Config, logger *slog.Logger) (*RouterService, error) {
+	m := metrics.New()
+	opts, err := cfg.Database()
+	if err != nil {
+		return &RouterService{}, err
+	}
+	Ctrlr, err := controller.NewController(opts, logger.With("component", "controller"), m)
 	if err != nil {
 		return &RouterService{}, err
 	}
-	return &RouterService{Ctrlr, httpPort, httpsPort, certPath, keyPath}, nil
+	if Ctrlr.Invites, err = cfg.Invites(); err != nil {
+		return &RouterService{}, err
+	}
+	if Ctrlr.Registration, err = cfg.Registration(); err != nil {
+		return &RouterService{}, err
+	}
+	Ctrlr.DeletedRetention = cfg.DeletedRetention
+	rtr := &RouterService{Ctrlr: Ctrlr, Logger: logger.With("component", "router"), Metrics: m, cfg: cfg}
+	if cfg.RegistrationRateLimit > 0 {
+		rtr.registerLimiter = newRateLimiter(cfg.RegistrationRateLimit, time.Hour)
+	}
+	rtr.redirectServer = rtr.newServer(cfg.HTTPAddr, rtr.withRequestID(rtr.instrument("redirect", http.HandlerFunc(rtr.redirectTLS))))
+	rtr.httpsServer = rtr.newServer(cfg.HTTPSAddr, rtr.withRequestID(rtr.routes()))
+	rtr.adminServer = rtr.newServer(cfg.AdminAddr, rtr.adminMux())
+	return rtr, nil
 }
 
+// newServer creates an http.Server with the configured timeouts, logging its internal errors through the router's logger
+func (rtr *RouterService) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: rtr.cfg.ReadHeaderTimeout,
+		ReadTimeout:       rtr.cfg.ReadTimeout,
+		WriteTimeout:      rtr.cfg.WriteTimeout,
+		IdleTimeout:       rtr.cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(rtr.Logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// Start serves requests until Shutdown is called, after which it returns nil.
+// Any other error from the HTTPS listener is returned.
 func (rtr *RouterService) Start() error {
-	log.Printf("Starting webserver ... \n")
+	rtr.Logger.Info("Starting webserver", "http", rtr.cfg.HTTPAddr, "https", rtr.cfg.HTTPSAddr, "admin", rtr.cfg.AdminAddr)
+	tlsConfig, err := rtr.tlsConfig()
+	if err != nil {
+		rtr.Logger.Error("Invalid TLS configuration", "error", err)
+		return err
+	}
+	rtr.httpsServer.TLSConfig = tlsConfig
+	if store := rtr.certStore.Load(); store != nil {
+		store.Watch(rtr.cfg.CertReloadInterval)
+	}
+	rtr.Ctrlr.TokenUtil.StartJanitor(rtr.cfg.JanitorInterval)
+	rtr.Ctrlr.StartPurger(rtr.cfg.PurgeInterval)
+
 	//start listening for http to redirect to https
 	go func() {
-		log.Print(http.ListenAndServe(rtr.httpPort, http.HandlerFunc(rtr.redirectTLS)))
+		err := rtr.redirectServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			rtr.Logger.Error("HTTP redirect listener stopped", "error", err)
+		}
 	}()
 
+	//start listening for operational endpoints on a separate port that need not be exposed publicly
+	if rtr.cfg.AdminAddr != "" {
+		go func() {
+			err := rtr.adminServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				rtr.Logger.Error("Admin listener stopped", "error", err)
+			}
+		}()
+	}
+
 	//start listening for https and handle requests
-	err := rtr.handleRequests(rtr.certPath, rtr.keyPath)
+	err = rtr.handleRequests()
 	if err != nil {
-		log.Printf("HandleRequests Error: %v \n", err)
+		rtr.Logger.Error("HandleRequests failed", "error", err)
 		return err
 	}
 	return nil
 }
 
-func (rtr *RouterService) handleRequests(certPath, keyPath string) error {
+// Shutdown stops accepting connections and waits for in-flight requests to finish or ctx to expire.
+// The public listeners are drained first while the admin listener keeps reporting /readyz as unavailable,
+// then the certificate watcher, blocklist janitor and purger are stopped and finally the database connections are closed.
+func (rtr *RouterService) Shutdown(ctx context.Context) error {
+	rtr.Logger.Info("Shutting down webserver")
+	rtr.shuttingDown.Store(true)
+
+	var errs []error
+	for _, srv := range []*http.Server{rtr.httpsServer, rtr.redirectServer, rtr.adminServer} {
+		if err := srv.Shutdown(ctx); err != nil {
+			rtr.Logger.Error("Listener did not shut down cleanly", "addr", srv.Addr, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	if store := rtr.certStore.Load(); store != nil {
+		store.Stop()
+	}
+	if err := rtr.Ctrlr.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (rtr *RouterService) routes() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir("iotdashboard/iotdbfrontend/build/")))
-	mux.HandleFunc("/login", rtr.loginHandler)
-	mux.HandleFunc("/logout", rtr.logoutHandler)
-	mux.HandleFunc("/csrf", rtr.csrfHandler)
-	log.Printf("Running! \n")
-	err := http.ListenAndServeTLS(rtr.httpsPort, certPath, keyPath, mux)
-	if err != nil {
-		log.Printf("ListenAndServeTLS Error: %v /n", err)
+	rtr.handle(mux, "/", http.FileServer(http.Dir("iotdashboard/iotdbfrontend/build/")))
+	rtr.handle(mux, "/login", http.HandlerFunc(rtr.loginHandler))
+	rtr.handle(mux, "/logout", http.HandlerFunc(rtr.logoutHandler))
+	rtr.handle(mux, "/csrf", http.HandlerFunc(rtr.csrfHandler))
+	rtr.handle(mux, "/setup", http.HandlerFunc(rtr.setupHandler))
+	rtr.handle(mux, "/invite", http.HandlerFunc(rtr.inviteHandler))
+	rtr.handle(mux, "/admin/invitations", rtr.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAdmin, rtr.invitationsHandler))
+	rtr.handle(mux, "/register", rtr.rateLimit(rtr.registerLimiter, rtr.registerHandler))
+	rtr.handle(mux, "/admin/registrations", rtr.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAdmin, rtr.registrationsHandler))
+	rtr.handle(mux, "/admin/registrations/{id}", rtr.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAdmin, rtr.registrationHandler))
+	rtr.handle(mux, "/admin/audit", rtr.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAuditRead, rtr.auditHandler))
+	rtr.handle(mux, "/api/keys", rtr.requireAuth(rtr.apiKeysHandler))
+	rtr.handle(mux, "/api/keys/{id}", rtr.requireAuth(rtr.apiKeyHandler))
+	rtr.handle(mux, "/admin/oauth/clients", rtr.requireRole(dbmanager.RoleAdmin, dbmanager.ScopeAdmin, rtr.oauthClientsHandler))
+	rtr.handle(mux, "/oauth/authorize", http.HandlerFunc(rtr.authorizeHandler))
+	rtr.handle(mux, "/oauth/consent", rtr.requireAuth(rtr.consentHandler))
+	rtr.handle(mux, "/oauth/token", http.HandlerFunc(rtr.tokenHandler))
+	rtr.handle(mux, "/oauth/introspect", http.HandlerFunc(rtr.introspectHandler))
+	rtr.handle(mux, "/oauth/revoke", http.HandlerFunc(rtr.revokeHandler))
+	rtr.handle(mux, "/auth/verify", http.HandlerFunc(rtr.verifyHandler))
+	rtr.handle(mux, "/introspect", rtr.requireAuth(requireScope(dbmanager.ScopeIntrospect, rtr.tokenIntrospectHandler)))
+	rtr.handle(mux, "/healthz", http.HandlerFunc(rtr.healthzHandler))
+	rtr.handle(mux, "/readyz", http.HandlerFunc(rtr.readyzHandler))
+	return mux
+}
+
+// tlsConfig loads the configured certificates and builds the TLS settings of the HTTPS listener
+func (rtr *RouterService) tlsConfig() (*tls.Config, error) {
+	specs := []certs.Spec{{CertPath: rtr.cfg.CertPath, KeyPath: rtr.cfg.KeyPath, OCSPPath: rtr.cfg.OCSPPath}}
+	extra, err := certs.ParseSpecs(rtr.cfg.ExtraCerts)
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := certs.ParseMinVersion(rtr.cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := certs.ParseCipherSuites(rtr.cfg.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if rtr.cfg.TLSClientCA != "" {
+		// Client certificates are optional so browsers can still log in with a password
+		if tlsConfig.ClientCAs, err = certs.LoadCertPool(rtr.cfg.TLSClientCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	store, err := certs.NewStore(append(specs, extra...), rtr.Logger.With("component", "certs"))
+	domains := certs.ParseDomains(rtr.cfg.ACMEDomains)
+	if len(domains) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		rtr.certStore.Store(store)
+		tlsConfig.GetCertificate = store.GetCertificate
+		return tlsConfig, nil
+	}
+
+	// In ACME mode certificate files are optional and only serve names that are not managed by ACME
+	if err != nil {
+		rtr.Logger.Warn("No certificate files loaded, serving ACME certificates only", "error", err)
+		store = nil
+	} else {
+		rtr.certStore.Store(store)
+	}
+	manager, err := certs.NewACMEManager(certs.ACMEConfig{
+		Domains:      domains,
+		DirectoryURL: rtr.cfg.ACMEDirectoryURL,
+		Email:        rtr.cfg.ACMEEmail,
+		CacheDir:     rtr.cfg.ACMECacheDir,
+		CABundle:     rtr.cfg.ACMECABundle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rtr.Logger.Info("ACME certificate provisioning enabled", "domains", domains, "directory", manager.Client.DirectoryURL)
+	// HTTP-01 challenges are answered on the redirect listener, everything else is still redirected
+	rtr.redirectServer.Handler = rtr.withRequestID(rtr.instrument("redirect", manager.HTTPHandler(http.HandlerFunc(rtr.redirectTLS))))
+	tlsConfig.GetCertificate = certs.WithACME(manager, domains, store)
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	return tlsConfig, nil
+}
+
+// ReloadCertificates re-reads the TLS certificates from disk, e.g. on SIGHUP
+func (rtr *RouterService) ReloadCertificates() error {
+	store := rtr.certStore.Load()
+	if store == nil {
+		return errors.New("Server has not been started")
+	}
+	return store.Reload()
+}
+
+func (rtr *RouterService) handleRequests() error {
+	rtr.Logger.Info("Running!")
+	// the certificates are provided by TLSConfig.GetCertificate
+	err := rtr.httpsServer.ListenAndServeTLS("", "")
+	if err != nil && err != http.ErrServerClosed {
+		rtr.Logger.Error("ListenAndServeTLS failed", "error", err)
 		return err
 	}
 	return nil
@@ -73,7 +272,7 @@ func (rtr *RouterService) loginHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the JSON body and decode into credentials
 	err := json.NewDecoder(r.Body).Decode(&creds)
 	if err != nil {
-		log.Printf("LoginHandler Error: %v /n", err)
+		rtr.Logger.InfoContext(r.Context(), "LoginHandler could not decode body", "error", err)
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
@@ -82,12 +281,19 @@ func (rtr *RouterService) loginHandler(w http.ResponseWriter, r *http.Request) {
 	err = rtr.validateCSRF(w, r, creds)
 	if err != nil {
 		// error is returned to client in validateCSRF function
-		log.Printf("CSRF Validation err: %v", err)
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
 		return
 	}
 
 	//Perform Login
-	jwt, err := rtr.Ctrlr.Login(creds.Email, creds.Password)
+	login := creds.Email
+	if login == "" {
+		login = creds.Username
+	}
+	jwt, err := rtr.Ctrlr.Login(r.Context(), login, creds.Password, clientInfo(r))
+	if rtr.unavailable(w, r, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Email and Password do not match", http.StatusUnauthorized)
 		return
@@ -96,6 +302,7 @@ func (rtr *RouterService) loginHandler(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "JWT",
 		Value:    jwt,
+		Domain:   rtr.cfg.CookieDomain,
 		Secure:   true,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -114,7 +321,7 @@ func (rtr *RouterService) logoutHandler(w http.ResponseWriter, r *http.Request)
 	// No validation happens on credentials, except for CSRF token
 	err := json.NewDecoder(r.Body).Decode(&creds)
 	if err != nil {
-		log.Printf("LogoutHandler Error: %v /n", err)
+		rtr.Logger.InfoContext(r.Context(), "LogoutHandler could not decode body", "error", err)
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
@@ -123,7 +330,7 @@ func (rtr *RouterService) logoutHandler(w http.ResponseWriter, r *http.Request)
 	err = rtr.validateCSRF(w, r, creds)
 	if err != nil {
 		// error is returned to client in validateCSRF function
-		log.Printf("CSRF Validation err: %v", err)
+		rtr.Logger.InfoContext(r.Context(), "CSRF validation failed", "error", err)
 		return
 	}
 
@@ -137,7 +344,7 @@ func (rtr *RouterService) logoutHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = rtr.Ctrlr.Logout(jwtCookie.Value)
+	err = rtr.Ctrlr.Logout(r.Context(), jwtCookie.Value, clientInfo(r))
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -153,7 +360,7 @@ func (rtr *RouterService) csrfHandler(w http.ResponseWriter, r *http.Request) {
 
 	csrf, err := rtr.Ctrlr.TokenUtil.GenerateRandomString(128)
 	if err != nil {
-		log.Printf("CSRFHandler Error: %v /n", err)
+		rtr.Logger.ErrorContext(r.Context(), "CSRF token generation failed", "error", err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
@@ -170,20 +377,67 @@ func (rtr *RouterService) redirectTLS(w http.ResponseWriter, r *http.Request) {
 	//discarding old port value
 	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		log.Printf("Redirect TLS Error: %v /n", err)
+		rtr.Logger.InfoContext(r.Context(), "Redirect TLS could not parse host", "host", r.Host, "error", err)
 		return
 	}
 	u := r.URL
-	u.Host = net.JoinHostPort(host, rtr.httpsPort[1:])
+	_, httpsPort, err := net.SplitHostPort(rtr.cfg.HTTPSAddr)
+	if err != nil {
+		rtr.Logger.ErrorContext(r.Context(), "Redirect TLS could not parse HTTPS address", "addr", rtr.cfg.HTTPSAddr, "error", err)
+		return
+	}
+	u.Host = net.JoinHostPort(host, httpsPort)
 	u.Scheme = "https"
 	target := u.String()
 
-	log.Printf("redirect to: %s", target)
+	rtr.Logger.DebugContext(r.Context(), "Redirecting to TLS", "target", target)
 	http.Redirect(w, r, target,
 		http.StatusPermanentRedirect)
 
 }
 
+// withRequestID tags every request with an ID that is echoed in the X-Request-ID header
+// and carried in the request context so that log lines can be correlated
+func (rtr *RouterService) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := rtr.Ctrlr.TokenUtil.GenerateRandomString(16)
+		if err != nil {
+			rtr.Logger.Error("Request ID generation failed", "error", err)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(utils.WithRequestID(r.Context(), id)))
+	})
+}
+
+// unavailable answers with 504 if err means a database operation timed out, or 503 if the request was cancelled
+// or too many passwords were being checked, and reports whether it did. Handlers call it before mapping other
+// errors to their own responses.
+func (rtr *RouterService) unavailable(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !controller.IsUnavailable(err) {
+		return false
+	}
+	rtr.Logger.WarnContext(r.Context(), "Request aborted", "path", r.URL.Path, "error", err)
+	if errors.Is(err, controller.ErrBusy) {
+		// the queue drains within moments, unlike a database that stopped answering
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	} else {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+// clientInfo extracts the client details recorded in the audit log
+func clientInfo(r *http.Request) controller.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return controller.ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
 // TODO: turn this into middleware:
 func (rtr *RouterService) validateCSRF(w http.ResponseWriter, r *http.Request, creds Credentials) error {
 	csrfCookie, err := r.Cookie("CSRF")
@@ -192,7 +446,7 @@ func (rtr *RouterService) validateCSRF(w http.ResponseWriter, r *http.Request, c
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return errors.New("Missing CSRF cookie")
 		}
-		log.Printf("ValidateCSRF Error: %v /n", err)
+		rtr.Logger.InfoContext(r.Context(), "ValidateCSRF could not read cookie", "error", err)
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return err
 	}
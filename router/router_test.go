@@ -1,7 +1,13 @@
 package router
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"iotdashboard/config"
+	"iotdashboard/controller"
+	"iotdashboard/utils"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -10,8 +16,11 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+var testLogger = utils.NewLogger(io.Discard, "text", slog.LevelInfo)
+
 func TestLoginHandler(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -19,12 +28,14 @@ func TestLoginHandler(t *testing.T) {
 	}
 	defer db.Close()
 
-	router, err := NewRouter(":8080", ":9090", "server-cert.pem", "server-key.pem")
+	router, err := NewRouter(config.Default(), testLogger)
 	if err != nil {
 		t.Fatalf("Could not initialize router: %v \n", err)
 	}
 	//overwrite db connection with mock
 	router.Ctrlr.PSQL.DB = db
+	// rejected requests never reach the database, so expectations may be left over between cases
+	mock.MatchExpectationsInOrder(false)
 
 	cases := []struct {
 		method, path, email, pass, hashedPassword, csrfC, csrfB string
@@ -39,10 +50,17 @@ func TestLoginHandler(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		rows := sqlmock.NewRows([]string{"password"}).
-			AddRow(c.hashedPassword)
-		mock.ExpectQuery(regexp.QuoteMeta("SELECT password from users WHERE email = $1")).
+		rows := sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).
+			AddRow(c.hashedPassword, "active", 0, nil)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
 			WillReturnRows(rows)
+		if c.status == http.StatusOK {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+				WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+					AddRow(1, c.email, "", "user", "active", nil, time.Now()))
+		}
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+			WillReturnResult(sqlmock.NewResult(1, 1))
 
 		// Create test request
 		bodyReader := strings.NewReader(fmt.Sprintf(`{"email": "%s", "password": "%s", "csrf": "%s"}`, c.email, c.pass, c.csrfB))
@@ -86,18 +104,65 @@ func TestLoginHandler(t *testing.T) {
 	}
 }
 
+func TestLoginWithUsername(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email from users WHERE username = $1")).
+		WithArgs("tech1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@gmail.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WithArgs("user@gmail.com").
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT uid, email, COALESCE(username, ''), role, status, verified_at, created from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "email", "username", "role", "status", "verified_at", "created"}).
+			AddRow(1, "user@gmail.com", "tech1", "user", "active", nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+		WithArgs("login_success", "user@gmail.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username": "tech1", "password": "S3cure3Pa$$", "csrf": "123"}`))
+	req.AddCookie(&http.Cookie{Name: "CSRF", Value: "123"})
+	rr := httptest.NewRecorder()
+	router.loginHandler(rr, req)
+	if rr.Code != http.StatusOK || len(rr.Result().Cookies()) == 0 || rr.Result().Cookies()[0].Name != "JWT" {
+		t.Errorf("Login with a username returned %d with cookies %v", rr.Code, rr.Result().Cookies())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
 func TestLogoutHandler(t *testing.T) {
-	router, err := NewRouter(":8080", ":9090", "server-cert.pem", "server-key.pem")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
 	if err != nil {
 		t.Fatalf("Could not initialize router: %v \n", err)
 	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	mock.MatchExpectationsInOrder(false)
 
-	token1, err := router.Ctrlr.TokenUtil.CreateJWT(time.Second * 15)
+	token1, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "user", time.Second*15)
 	if err != nil {
 		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
 	}
 
-	token2, err := router.Ctrlr.TokenUtil.CreateJWT(time.Second * 15)
+	token2, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "user", time.Second*15)
 	if err != nil {
 		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
 	}
@@ -115,6 +180,12 @@ func TestLogoutHandler(t *testing.T) {
 	}
 
 	for _, c := range cases {
+		expectSessionCheck(mock)
+		if c.status == http.StatusOK {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+
 		// Create test request
 		bodyReader := strings.NewReader(fmt.Sprintf(`{"csrf": "%s"}`, c.csrfB))
 
@@ -147,7 +218,7 @@ func TestLogoutHandler(t *testing.T) {
 }
 
 func TestCsrfHandler(t *testing.T) {
-	router, err := NewRouter(":8080", ":9090", "server-cert.pem", "server-key.pem")
+	router, err := NewRouter(config.Default(), testLogger)
 	if err != nil {
 		t.Fatalf("Could not initialize router: %v \n", err)
 	}
@@ -200,7 +271,7 @@ func TestCsrfHandler(t *testing.T) {
 // func TestValidateCSRF(t *testing.T){} -> validated through request handler testing
 
 func TestRedirectTLS(t *testing.T) {
-	router, err := NewRouter(":8080", ":9090", "server-cert.pem", "server-key.pem")
+	router, err := NewRouter(config.Default(), testLogger)
 	if err != nil {
 		t.Fatalf("Could not initialize router: %v \n", err)
 	}
@@ -245,3 +316,207 @@ func TestRedirectTLS(t *testing.T) {
 		}
 	}
 }
+
+func TestWithRequestID(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+
+	var ctxID string
+	handler := router.withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID = utils.RequestIDFromContext(r.Context())
+	}))
+
+	req, err := http.NewRequest("GET", "/csrf", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request %v \n", err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	headerID := rr.Result().Header.Get("X-Request-ID")
+	if headerID == "" || headerID != ctxID {
+		t.Errorf("Request ID mismatch: header %q - context %q \n", headerID, ctxID)
+	}
+}
+
+func TestStartAndShutdown(t *testing.T) {
+	cfg := config.Default()
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.HTTPSAddr = "127.0.0.1:0"
+	cfg.AdminAddr = "127.0.0.1:0"
+	cfg.CertPath = "../server-cert.pem"
+	cfg.KeyPath = "../server-key.pem"
+
+	router, err := NewRouter(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- router.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := router.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v \n", err)
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start returned an error after shutdown: %v \n", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Start did not return after shutdown")
+	}
+	if err := router.Ctrlr.PSQL.DB.Ping(); err == nil {
+		t.Errorf("Database connections were not closed")
+	}
+}
+
+func TestACMETLSConfig(t *testing.T) {
+	cfg := config.Default()
+	cfg.CertPath = "missing-cert.pem"
+	cfg.ACMEDomains = "dashboard.example.com"
+	cfg.ACMECacheDir = t.TempDir()
+
+	router, err := NewRouter(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	tlsConfig, err := router.tlsConfig()
+	if err != nil {
+		t.Fatalf("ACME mode should not require certificate files: %v \n", err)
+	}
+	if tlsConfig.NextProtos[len(tlsConfig.NextProtos)-1] != "acme-tls/1" {
+		t.Errorf("TLS-ALPN-01 protocol is not offered: %v \n", tlsConfig.NextProtos)
+	}
+
+	//HTTP-01 challenges are answered by the redirect listener, other requests are still redirected
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"http://dashboard.example.com/.well-known/acme-challenge/unknown-token", http.StatusNotFound},
+		{"http://attacker.example.org/.well-known/acme-challenge/unknown-token", http.StatusForbidden},
+		{"http://dashboard.example.com:8080/login", http.StatusPermanentRedirect},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.url, nil)
+		rr := httptest.NewRecorder()
+		router.redirectServer.Handler.ServeHTTP(rr, req)
+		if rr.Code != c.status {
+			t.Errorf("GET %s returned %v, want %v \n", c.url, rr.Code, c.status)
+		}
+	}
+}
+
+func TestLoginHandlerUnavailable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	router.Ctrlr.PSQL.QueryTimeout = 10 * time.Millisecond
+	mock.MatchExpectationsInOrder(false)
+
+	cases := []struct {
+		delay  time.Duration
+		cancel bool
+		status int
+	}{
+		{time.Second, false, http.StatusGatewayTimeout},
+		{0, true, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+			WillDelayFor(c.delay).
+			WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, nil))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if c.cancel {
+			cancel()
+		}
+		bodyReader := strings.NewReader(`{"email": "user@gmail.com", "password": "S3cure3Pa$$", "csrf": "123"}`)
+		req := httptest.NewRequestWithContext(ctx, "POST", "/login", bodyReader)
+		req.AddCookie(&http.Cookie{Name: "CSRF", Value: "123"})
+
+		rr := httptest.NewRecorder()
+		router.loginHandler(rr, req)
+		cancel()
+		if rr.Code != c.status {
+			t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, c.status)
+		}
+	}
+}
+
+func TestLoginHandlerBusy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT password, status, failed_logins, locked_until from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"password", "status", "failed_logins", "locked_until"}).AddRow("$2a$10$cRmL5Rtm0bunl1uqYAP.8OfJE36RUkvMcX3.v0kJyY2JBhalX4KEG", "active", 0, nil))
+
+	// occupy the only slot and the only place in the queue
+	limiter := controller.NewHashLimiter(1, 1, router.Metrics)
+	router.Ctrlr.PSQL.HashLimiter = limiter
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v \n", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		limiter.Acquire(ctx)
+	}()
+	for testutil.ToFloat64(router.Metrics.PasswordHashQueue) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	bodyReader := strings.NewReader(`{"email": "user@gmail.com", "password": "S3cure3Pa$$", "csrf": "123"}`)
+	req := httptest.NewRequest("POST", "/login", bodyReader)
+	req.AddCookie(&http.Cookie{Name: "CSRF", Value: "123"})
+	rr := httptest.NewRecorder()
+	router.loginHandler(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Busy response has no Retry-After header")
+	}
+	cancel()
+	<-queued
+	release()
+}
+
+// expectSessionCheck expects a JWT to be checked against the time its subject's sessions were last revoked, which they
+// never were, and the subject's status, which is active
+func expectSessionCheck(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).
+		WillReturnRows(sqlmock.NewRows([]string{"sessions_revoked_at", "status"}).AddRow(nil, "active"))
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"iotdashboard/controller"
+	"iotdashboard/dbmanager"
+	"net/http"
+)
+
+// SetupRequest is the body of a request to create the first admin with the setup token logged on startup
+type SetupRequest struct {
+	Token    string `json:"token"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// setupHandler reports on GET whether the first admin still has to be created, and creates it on POST.
+// Once that has happened, the endpoint answers 410 Gone for good.
+func (rtr *RouterService) setupHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"pending": rtr.Ctrlr.SetupPending()})
+
+	case "POST":
+		if !rtr.Ctrlr.SetupPending() {
+			http.Error(w, "Gone", http.StatusGone)
+			return
+		}
+		var req SetupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		err := rtr.Ctrlr.CompleteSetup(r.Context(), req.Token, req.Email, req.Password, clientInfo(r))
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusCreated)
+		case err == controller.ErrInvalidSetupToken:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		case err == dbmanager.ErrBootstrapDone:
+			http.Error(w, "Gone", http.StatusGone)
+		case errors.Is(err, controller.ErrInvalidAdmin):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case rtr.unavailable(w, r, err):
+		default:
+			rtr.Logger.ErrorContext(r.Context(), "Setup failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"iotdashboard/config"
+	"iotdashboard/controller"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSetupHandler(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT NOT EXISTS (SELECT 1 FROM bootstrap)")).
+		WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(true))
+	token, err := router.Ctrlr.Bootstrap(context.Background(), "", "", controller.ClientInfo{})
+	if err != nil || token == "" {
+		t.Fatalf("Bootstrap did not issue a setup token: %v \n", err)
+	}
+
+	cases := []struct {
+		req     SetupRequest
+		success bool
+		status  int
+	}{
+		{SetupRequest{"wrong", "admin@gmail.com", "S3cure3Pa$$"}, false, http.StatusForbidden},
+		{SetupRequest{token, "admin", "S3cure3Pa$$"}, false, http.StatusBadRequest},
+		{SetupRequest{token, "admin@gmail.com", "short"}, false, http.StatusBadRequest},
+		{SetupRequest{token, "admin@gmail.com", "S3cure3Pa$$"}, true, http.StatusCreated},
+		//bootstrap is disabled for good
+		{SetupRequest{token, "admin@gmail.com", "S3cure3Pa$$"}, false, http.StatusGone},
+	}
+
+	for _, c := range cases {
+		if c.success {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO bootstrap(id)")).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM users)")).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users(email,password,role)")).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_events")).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		body, _ := json.Marshal(c.req)
+		rr := httptest.NewRecorder()
+		router.setupHandler(rr, httptest.NewRequest("POST", "/setup", bytes.NewReader(body)))
+		if rr.Code != c.status {
+			t.Errorf("Setup for %q returned %v, want %v", c.req.Email, rr.Code, c.status)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.setupHandler(rr, httptest.NewRequest("GET", "/setup", nil))
+	var status map[string]bool
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil || status["pending"] {
+		t.Errorf("Setup still reported as pending: %q", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
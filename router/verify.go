@@ -0,0 +1,84 @@
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// verifyHandler implements forward authentication for reverse proxies such as nginx auth_request and Traefik ForwardAuth.
+// Requests with a valid JWT cookie are answered with 200 and the X-Auth-User and X-Auth-Roles headers.
+// Otherwise the user is sent to the login page, with return_to pointing back at the original URL if it is on an allowed domain.
+// nginx, recognised by the X-Original-URL header, only accepts a 401 from auth_request, so it gets the login URL in the Location header
+// to redirect to itself; other proxies get a 302.
+// If the session could not be checked because the database did not answer, the proxy gets a 503 or 504 instead of
+// sending a signed in user back to the login page.
+func (rtr *RouterService) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	rtr.addHeaders(w)
+	if jwtCookie, err := r.Cookie("JWT"); err == nil {
+		claims, err := rtr.Ctrlr.Authenticate(r.Context(), jwtCookie.Value)
+		if err == nil {
+			w.Header().Set("X-Auth-User", claims.Subject)
+			w.Header().Set("X-Auth-Roles", claims.Role)
+			return
+		}
+		if rtr.unavailable(w, r, err) {
+			return
+		}
+	}
+
+	login, err := url.Parse(rtr.cfg.LoginURL)
+	if err != nil {
+		rtr.Logger.ErrorContext(r.Context(), "Invalid login URL", "url", rtr.cfg.LoginURL, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if returnTo := rtr.safeReturnTo(originalURL(r)); returnTo != "" {
+		query := login.Query()
+		query.Set("return_to", returnTo)
+		login.RawQuery = query.Encode()
+	}
+
+	if r.Header.Get("X-Original-URL") != "" {
+		w.Header().Set("Location", login.String())
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, login.String(), http.StatusFound)
+}
+
+// originalURL reconstructs the URL the user requested from the headers set by nginx or Traefik
+func originalURL(r *http.Request) string {
+	if original := r.Header.Get("X-Original-URL"); original != "" {
+		return original
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	return proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+}
+
+// safeReturnTo returns raw if it is an absolute http(s) URL on one of the ForwardAuthDomains, so that return_to cannot
+// be abused to redirect users to arbitrary sites. Anything else yields an empty string.
+func (rtr *RouterService) safeReturnTo(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range strings.Split(rtr.cfg.ForwardAuthDomains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return u.String()
+		}
+	}
+	return ""
+}
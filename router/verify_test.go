@@ -0,0 +1,143 @@
+package router
+
+import (
+	"context"
+	"iotdashboard/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestVerifyHandler(t *testing.T) {
+	cfg := config.Default()
+	cfg.LoginURL = "https://auth.example.com/"
+	cfg.ForwardAuthDomains = "example.com, iot.internal"
+	router, err := NewRouter(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+
+	session, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+
+	cases := []struct {
+		jwt      string
+		headers  map[string]string
+		status   int
+		returnTo string
+	}{
+		{session, nil, http.StatusOK, ""},
+		//Traefik
+		{"", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "grafana.example.com", "X-Forwarded-Uri": "/d/abc?x=1"},
+			http.StatusFound, "https://grafana.example.com/d/abc?x=1"},
+		{"expired", map[string]string{"X-Forwarded-Host": "node-red.iot.internal", "X-Forwarded-Uri": "/"},
+			http.StatusFound, "https://node-red.iot.internal/"},
+		//nginx
+		{"", map[string]string{"X-Original-URL": "https://grafana.example.com/"}, http.StatusUnauthorized, "https://grafana.example.com/"},
+		//open redirects are dropped
+		{"", map[string]string{"X-Original-URL": "https://example.com.attacker.org/"}, http.StatusUnauthorized, ""},
+		{"", map[string]string{"X-Forwarded-Host": "attacker.org", "X-Forwarded-Uri": "/"}, http.StatusFound, ""},
+		{"", map[string]string{"X-Original-URL": "javascript://example.com/%0aalert(1)"}, http.StatusUnauthorized, ""},
+		{"", map[string]string{"X-Original-URL": "https://user@example.com/"}, http.StatusUnauthorized, ""},
+		{"", nil, http.StatusFound, ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/auth/verify", nil)
+		if c.jwt != "" {
+			req.AddCookie(&http.Cookie{Name: "JWT", Value: c.jwt})
+		}
+		if c.status == http.StatusOK {
+			expectSessionCheck(mock)
+		}
+		for key, value := range c.headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		router.verifyHandler(rr, req)
+
+		if rr.Code != c.status {
+			t.Errorf("Verify with headers %v returned %v, want %v", c.headers, rr.Code, c.status)
+			continue
+		}
+		if c.status == http.StatusOK {
+			if rr.Header().Get("X-Auth-User") != "user@gmail.com" || rr.Header().Get("X-Auth-Roles") != "admin" {
+				t.Errorf("Missing identity headers: %v", rr.Header())
+			}
+			continue
+		}
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil || location.Host != "auth.example.com" {
+			t.Errorf("Unexpected login redirect %q", rr.Header().Get("Location"))
+			continue
+		}
+		if returnTo := location.Query().Get("return_to"); returnTo != c.returnTo {
+			t.Errorf("Verify with headers %v returned return_to %q, want %q", c.headers, returnTo, c.returnTo)
+		}
+	}
+}
+
+func TestVerifyHandlerUnavailable(t *testing.T) {
+	router, err := NewRouter(config.Default(), testLogger)
+	if err != nil {
+		t.Fatalf("Could not initialize router: %v \n", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock database: %v \n", err)
+	}
+	defer db.Close()
+	//overwrite db connection with mock
+	router.Ctrlr.PSQL.DB = db
+	router.Ctrlr.PSQL.QueryTimeout = 10 * time.Millisecond
+
+	session, err := router.Ctrlr.TokenUtil.CreateJWT("user@gmail.com", "admin", time.Second*15)
+	if err != nil {
+		t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+	}
+
+	cases := []struct {
+		delay  time.Duration
+		cancel bool
+		status int
+	}{
+		{time.Second, false, http.StatusGatewayTimeout},
+		{0, true, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT sessions_revoked_at, status from users WHERE email = $1")).
+			WillDelayFor(c.delay).
+			WillReturnRows(sqlmock.NewRows([]string{"sessions_revoked_at", "status"}).AddRow(nil, "active"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if c.cancel {
+			cancel()
+		}
+		req := httptest.NewRequestWithContext(ctx, "GET", "/auth/verify", nil)
+		req.AddCookie(&http.Cookie{Name: "JWT", Value: session})
+		rr := httptest.NewRecorder()
+		router.verifyHandler(rr, req)
+		cancel()
+		if rr.Code != c.status {
+			t.Errorf("Verify returned %v, want %v", rr.Code, c.status)
+		}
+		if rr.Header().Get("Location") != "" {
+			t.Errorf("Verify redirected to %q while the database was unavailable", rr.Header().Get("Location"))
+		}
+	}
+}
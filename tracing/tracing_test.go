@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), "file", path)
+	if err != nil {
+		t.Fatalf("Failed to set up tracing: %v \n", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "TestSpan")
+	End(span, errors.New("something broke"))
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down tracing: %v \n", err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v \n", err)
+	}
+	for _, e := range []string{`"Name":"TestSpan"`, "something broke", ServiceName} {
+		if !strings.Contains(string(out), e) {
+			t.Errorf("Trace file is missing %q: %s", e, out)
+		}
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), "carrier-pigeon", ""); err == nil {
+		t.Errorf("Setup succeeded with an unknown exporter")
+	}
+}
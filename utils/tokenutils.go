@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,24 +16,70 @@ type TokenUtil struct {
 	jwtKey []byte
 	//Blocklist key is the JWT and the value is the expiration epoch time
 	blocklist *sync.Map
+	Logger    *slog.Logger
+
+	janitorStop chan struct{}
+	janitorDone chan struct{}
 }
 
 var ErrExpiredToken = errors.New("Token is expired")
 
-func NewTokenUtil() (*TokenUtil, error) {
+// Claims are the JWT claims issued for a logged in user. The user's email is the subject.
+// Scope is a space separated list of granted scopes; it is empty for interactive sessions, which are not limited.
+// ClientID names the OAuth client a token was issued to.
+type Claims struct {
+	Role     string `json:"role"`
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	jwt.StandardClaims
+}
+
+// HasScope reports whether the claims grant scope. Claims without scopes grant every scope, unless they were issued
+// to an OAuth client: delegated access is limited to what was explicitly granted.
+func (c *Claims) HasScope(scope string) bool {
+	if c.Scope == "" {
+		return c.ClientID == ""
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func NewTokenUtil(logger *slog.Logger) (*TokenUtil, error) {
 	jwtKey, err := GenerateRandomToken(256)
 	if err != nil {
 		return &TokenUtil{}, err
 	}
-	return &TokenUtil{jwtKey, new(sync.Map)}, nil
+	return &TokenUtil{jwtKey: jwtKey, blocklist: new(sync.Map), Logger: logger}, nil
 }
 
-func (tu *TokenUtil) CreateJWT(validPeriod time.Duration) (string, error) {
-	claims := jwt.StandardClaims{
-		// In JWT, the expiry time is expressed as unix time
-		ExpiresAt: time.Now().UTC().Add(validPeriod).Unix(),
-		Issuer:    "iot-dash",
-		NotBefore: time.Now().UTC().Add(time.Second * -10).Unix(),
+func (tu *TokenUtil) CreateJWT(subject, role string, validPeriod time.Duration) (string, error) {
+	return tu.CreateScopedJWT(subject, role, "", "", validPeriod)
+}
+
+// CreateScopedJWT creates a token limited to the space separated scope, issued to an OAuth client
+// Every token gets a random ID (jti) that identifies the session it belongs to.
+func (tu *TokenUtil) CreateScopedJWT(subject, role, scope, clientID string, validPeriod time.Duration) (string, error) {
+	id, err := tu.GenerateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	claims := Claims{
+		Role:     role,
+		Scope:    scope,
+		ClientID: clientID,
+		StandardClaims: jwt.StandardClaims{
+			// In JWT, the expiry time is expressed as unix time
+			ExpiresAt: time.Now().UTC().Add(validPeriod).Unix(),
+			Id:        id,
+			IssuedAt:  time.Now().UTC().Unix(),
+			Issuer:    "iot-dash",
+			NotBefore: time.Now().UTC().Add(time.Second * -10).Unix(),
+			Subject:   subject,
+		},
 	}
 	token := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), claims)
 
@@ -48,32 +96,117 @@ func (tu *TokenUtil) GetJWTExpiry(rawToken string) (time.Time, error) {
 	if ok {
 		return exp.(time.Time), ErrExpiredToken
 	}
+	claims, err := tu.ParseJWT(rawToken)
+	if claims == nil {
+		return time.Time{}, err
+	}
+	return time.Unix(claims.ExpiresAt, 0), err
+}
+
+// ParseJWT verifies the signature, validity period and blocklist status of a token and returns its claims.
+// When the only problem is that the token is expired, the claims are returned along with ErrExpiredToken.
+func (tu *TokenUtil) ParseJWT(rawToken string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(
 		rawToken,
-		&jwt.StandardClaims{},
+		&Claims{},
 		func(rawToken *jwt.Token) (interface{}, error) {
+			if rawToken.Method != jwt.SigningMethodHS256 {
+				return nil, errors.New("Unexpected signing method")
+			}
 			return tu.jwtKey, nil
 		})
 	if err != nil {
-		return time.Time{}, err
+		if vErr, ok := err.(*jwt.ValidationError); ok && vErr.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) == 0 {
+			return token.Claims.(*Claims), ErrExpiredToken
+		}
+		tu.Logger.Debug("JWT parsing failed", "error", err)
+		return nil, err
 	}
 
-	claims, ok := token.Claims.(*jwt.StandardClaims)
+	claims, ok := token.Claims.(*Claims)
 	if !ok {
-		return time.Time{}, errors.New("Couldn't Parse Token Claims")
+		return nil, errors.New("Couldn't Parse Token Claims")
 	}
 
 	now := time.Now().UTC().Unix()
-	expiresAt := time.Unix(claims.ExpiresAt, 0)
 	if claims.ExpiresAt < now || now < claims.NotBefore {
-		return expiresAt, ErrExpiredToken
+		return claims, ErrExpiredToken
+	}
+	if _, blocked := tu.blocklist.Load(rawToken); blocked {
+		return claims, ErrExpiredToken
 	}
 
-	return expiresAt, nil
+	return claims, nil
 }
 
 func (tu *TokenUtil) BlockListToken(jwt string, expiration time.Time) {
 	tu.blocklist.Store(jwt, expiration)
+	tu.Logger.Debug("JWT added to blocklist", "expires", expiration)
+}
+
+// HasSigningKey reports whether a JWT signing key has been loaded
+func (tu *TokenUtil) HasSigningKey() bool {
+	return len(tu.jwtKey) > 0
+}
+
+// PurgeExpired removes tokens from the blocklist once they have expired, since they would be rejected anyway.
+// It returns the number of tokens removed.
+func (tu *TokenUtil) PurgeExpired() int {
+	now := time.Now()
+	n := 0
+	tu.blocklist.Range(func(token, exp interface{}) bool {
+		if exp.(time.Time).Before(now) {
+			tu.blocklist.Delete(token)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// StartJanitor purges expired tokens from the blocklist every interval until StopJanitor is called.
+// A non-positive interval disables the janitor.
+func (tu *TokenUtil) StartJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	tu.janitorStop = make(chan struct{})
+	tu.janitorDone = make(chan struct{})
+	go func() {
+		defer close(tu.janitorDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := tu.PurgeExpired(); n > 0 {
+					tu.Logger.Debug("Purged expired tokens from blocklist", "count", n)
+				}
+			case <-tu.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the janitor started by StartJanitor and waits for it to exit. It is a no-op if none is running.
+func (tu *TokenUtil) StopJanitor() {
+	if tu.janitorStop == nil {
+		return
+	}
+	close(tu.janitorStop)
+	<-tu.janitorDone
+	tu.janitorStop = nil
+}
+
+// BlocklistSize returns the number of tokens currently on the blocklist
+func (tu *TokenUtil) BlocklistSize() int {
+	n := 0
+	tu.blocklist.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
 }
 
 func (tu *TokenUtil) GenerateRandomString(n int) (string, error) {
@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"io"
+	"log/slog"
 	"testing"
 	"time"
 )
 
+var testLogger = NewLogger(io.Discard, "text", slog.LevelInfo)
+
 func TestGenerateRandomToken(t *testing.T) {
 	n := 256
 	key, err := GenerateRandomToken(n)
@@ -14,7 +18,7 @@ func TestGenerateRandomToken(t *testing.T) {
 }
 
 func TestGenerateRandomString(t *testing.T) {
-	tu, err := NewTokenUtil()
+	tu, err := NewTokenUtil(testLogger)
 	if err != nil {
 		t.Fatalf("Not able to create TokenUtil: %v \n", err)
 	}
@@ -26,11 +30,11 @@ func TestGenerateRandomString(t *testing.T) {
 }
 
 func TestCreateAndGetJWTExpiry(t *testing.T) {
-	tu, err := NewTokenUtil()
+	tu, err := NewTokenUtil(testLogger)
 	if err != nil {
 		t.Fatalf("Not able to create TokenUtil: %v \n", err)
 	}
-	token, err := tu.CreateJWT(time.Second * 1)
+	token, err := tu.CreateJWT("user@gmail.com", "user", time.Second*1)
 	if err != nil {
 		t.Errorf("JWT creation failed: %s", err)
 	}
@@ -54,16 +58,19 @@ func TestCreateAndGetJWTExpiry(t *testing.T) {
 }
 
 func TestCreateAndBlocklistJWT(t *testing.T) {
-	tu, err := NewTokenUtil()
+	tu, err := NewTokenUtil(testLogger)
 	if err != nil {
 		t.Fatalf("Not able to create TokenUtil: %v \n", err)
 	}
-	token, err := tu.CreateJWT(time.Second * 60)
+	token, err := tu.CreateJWT("user@gmail.com", "user", time.Second*60)
 	if err != nil {
 		t.Errorf("JWT creation failed: %s", err)
 	}
 
 	tu.BlockListToken(token, time.Now().UTC().Add(time.Second*60))
+	if tu.BlocklistSize() != 1 {
+		t.Errorf("Expected blocklist size 1, got: %d", tu.BlocklistSize())
+	}
 
 	//test validation of logged out token
 	_, err = tu.GetJWTExpiry(token)
@@ -71,3 +78,102 @@ func TestCreateAndBlocklistJWT(t *testing.T) {
 		t.Errorf("Validation succeeded when it should have failed")
 	}
 }
+
+func TestParseJWT(t *testing.T) {
+	tu, err := NewTokenUtil(testLogger)
+	if err != nil {
+		t.Fatalf("Not able to create TokenUtil: %v \n", err)
+	}
+	token, err := tu.CreateJWT("user@gmail.com", "admin", time.Second*60)
+	if err != nil {
+		t.Fatalf("JWT creation failed: %s", err)
+	}
+
+	claims, err := tu.ParseJWT(token)
+	if err != nil {
+		t.Fatalf("Parsing failed when it should have succeeded: %v", err)
+	}
+	if claims.Subject != "user@gmail.com" || claims.Role != "admin" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	//tokens signed with a different key must be rejected
+	other, err := NewTokenUtil(testLogger)
+	if err != nil {
+		t.Fatalf("Not able to create TokenUtil: %v \n", err)
+	}
+	if _, err = other.ParseJWT(token); err == nil {
+		t.Errorf("Parsing succeeded with the wrong key")
+	}
+
+	tu.BlockListToken(token, time.Now().UTC().Add(time.Second*60))
+	if _, err = tu.ParseJWT(token); err != ErrExpiredToken {
+		t.Errorf("Expected ErrExpiredToken for blocklisted token, got: %v", err)
+	}
+}
+
+func TestBlocklistJanitor(t *testing.T) {
+	tu, err := NewTokenUtil(testLogger)
+	if err != nil {
+		t.Fatalf("Not able to create TokenUtil: %v \n", err)
+	}
+	tu.BlockListToken("expired", time.Now().UTC().Add(-time.Second))
+	tu.BlockListToken("valid", time.Now().UTC().Add(time.Minute))
+
+	tu.StartJanitor(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	tu.StopJanitor()
+	//a second stop must not block or panic
+	tu.StopJanitor()
+
+	if tu.BlocklistSize() != 1 {
+		t.Errorf("Expected only the unexpired token to remain, blocklist size: %d", tu.BlocklistSize())
+	}
+	if _, err := tu.GetJWTExpiry("valid"); err != ErrExpiredToken {
+		t.Errorf("Unexpired token was removed from the blocklist")
+	}
+}
+
+func TestClaimsHasScope(t *testing.T) {
+	cases := []struct {
+		scope, clientID, want string
+		granted               bool
+	}{
+		{"", "", "audit:read", true},
+		{"audit:read keys:read", "", "keys:read", true},
+		{"audit:read", "", "keys:write", false},
+		{"keys:read", "", "keys", false},
+		//tokens of OAuth clients are never unlimited
+		{"", "grafana", "admin", false},
+		{"admin", "grafana", "admin", true},
+	}
+	for _, c := range cases {
+		claims := &Claims{Scope: c.scope, ClientID: c.clientID}
+		if claims.HasScope(c.want) != c.granted {
+			t.Errorf("Claims with scope %q granting %q: got %v, want %v", c.scope, c.want, !c.granted, c.granted)
+		}
+	}
+}
+
+func TestCreateScopedJWT(t *testing.T) {
+	tu, err := NewTokenUtil(testLogger)
+	if err != nil {
+		t.Fatalf("Failed to create token util: %v \n", err)
+	}
+	ids := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		token, err := tu.CreateScopedJWT("exporter", "user", "audit:read", "exporter", time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to generate a token. Error: \n %v \n", err)
+		}
+		claims, err := tu.ParseJWT(token)
+		if err != nil || claims.Scope != "audit:read" || claims.ClientID != "exporter" || claims.Id == "" {
+			t.Errorf("Unexpected claims %+v: %v", claims, err)
+			continue
+		}
+		ids[claims.Id] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("Token IDs are not unique: %v", ids)
+	}
+}